@@ -0,0 +1,330 @@
+// age-plugin-libp2p lets the standard age CLI encrypt to, and decrypt with,
+// libp2p peer keys.
+//
+//	age-plugin-libp2p -recipient <peer id>    print the age recipient for a peer
+//	age-plugin-libp2p -identity <key file>    print the age identity for a key
+//
+// The key file is a gemipfs identity, as made by the client, exits and repos,
+// and is decrypted with GEMIPFS_IDENTITY_PASSPHRASE if it is encrypted.
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	agep2p "github.com/willscott/go-gemipfs/age"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+const pluginName = "libp2p"
+
+func main() {
+	sm := flag.String("age-plugin", "", "age plugin state machine (set by age)")
+	recipient := flag.String("recipient", "", "print the age recipient for a peer ID")
+	identity := flag.String("identity", "", "print the age identity for a libp2p private key file")
+	flag.Parse()
+
+	var err error
+	switch {
+	case *sm == "recipient-v1":
+		err = recipientV1(os.Stdin, os.Stdout)
+	case *sm == "identity-v1":
+		err = identityV1(os.Stdin, os.Stdout)
+	case *sm != "":
+		err = fmt.Errorf("unsupported state machine: %s", *sm)
+	case *recipient != "":
+		err = printRecipient(*recipient)
+	case *identity != "":
+		err = printIdentity(*identity)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func printRecipient(pidStr string) error {
+	pid, err := peer.Decode(pidStr)
+	if err != nil {
+		return err
+	}
+	pk, err := pid.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("public key is not embedded in %s: %w", pid, err)
+	}
+	pkb, err := crypto.MarshalPublicKey(pk)
+	if err != nil {
+		return err
+	}
+	fmt.Println(plugin.EncodeRecipient(pluginName, pkb))
+	return nil
+}
+
+func printIdentity(keyFile string) error {
+	sk, err := gemipfs.LoadIdentity(keyFile)
+	if err != nil {
+		return err
+	}
+	skb, err := crypto.MarshalPrivateKey(sk)
+	if err != nil {
+		return err
+	}
+	pid, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return err
+	}
+	pkb, err := crypto.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# peer: %s\n", pid)
+	fmt.Printf("# recipient: %s\n", plugin.EncodeRecipient(pluginName, pkb))
+	fmt.Println(plugin.EncodeIdentity(pluginName, skb))
+	return nil
+}
+
+func parseRecipient(s string) (*agep2p.LibP2PRecipient, error) {
+	name, data, err := plugin.ParseRecipient(s)
+	if err != nil {
+		return nil, err
+	}
+	if name != pluginName {
+		return nil, fmt.Errorf("not a %s recipient", pluginName)
+	}
+	pk, err := crypto.UnmarshalPublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return agep2p.NewLibP2PRecipientFromKey(pk)
+}
+
+func parseIdentity(s string) (*agep2p.LibP2PIdentity, error) {
+	name, data, err := plugin.ParseIdentity(s)
+	if err != nil {
+		return nil, err
+	}
+	if name != pluginName {
+		return nil, fmt.Errorf("not a %s identity", pluginName)
+	}
+	sk, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return agep2p.NewLibP2PIdentity(sk), nil
+}
+
+func recipientV1(in io.Reader, out io.Writer) error {
+	r := bufio.NewReader(in)
+	var recipients []age.Recipient
+	var fileKeys [][]byte
+	var firstErr *age.Stanza
+
+	// Phase 1: collect recipients, identities and file keys.
+Phase1:
+	for {
+		s, err := readStanza(r)
+		if err != nil {
+			return err
+		}
+		switch s.Type {
+		case "add-recipient":
+			lr, err := parseRecipient(strings.Join(s.Args, " "))
+			if err != nil && firstErr == nil {
+				firstErr = errorStanza("recipient", len(recipients), err)
+			}
+			recipients = append(recipients, lr)
+		case "add-identity":
+			li, err := parseIdentity(strings.Join(s.Args, " "))
+			if err != nil {
+				if firstErr == nil {
+					firstErr = errorStanza("identity", len(recipients), err)
+				}
+				recipients = append(recipients, nil)
+				continue
+			}
+			lr, err := li.Recipient()
+			if err != nil && firstErr == nil {
+				firstErr = errorStanza("identity", len(recipients), err)
+			}
+			recipients = append(recipients, lr)
+		case "wrap-file-key":
+			fileKeys = append(fileKeys, s.Body)
+		case "done":
+			break Phase1
+		}
+	}
+
+	// Phase 2: respond with stanzas, or the first error.
+	if firstErr != nil {
+		return command(r, out, firstErr)
+	}
+	for i, fk := range fileKeys {
+		for j, rcpt := range recipients {
+			stanzas, err := rcpt.Wrap(fk)
+			if err != nil {
+				return command(r, out, errorStanza("recipient", j, err))
+			}
+			for _, s := range stanzas {
+				args := append([]string{strconv.Itoa(i), s.Type}, s.Args...)
+				if err := command(r, out, &age.Stanza{Type: "recipient-stanza", Args: args, Body: s.Body}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return writeStanza(out, &age.Stanza{Type: "done"})
+}
+
+func identityV1(in io.Reader, out io.Writer) error {
+	r := bufio.NewReader(in)
+	var identities []*agep2p.LibP2PIdentity
+	files := make(map[int][]*age.Stanza)
+	var order []int
+	var firstErr *age.Stanza
+
+	// Phase 1: collect identities and the stanzas of each file.
+Phase1:
+	for {
+		s, err := readStanza(r)
+		if err != nil {
+			return err
+		}
+		switch s.Type {
+		case "add-identity":
+			li, err := parseIdentity(strings.Join(s.Args, " "))
+			if err != nil && firstErr == nil {
+				firstErr = errorStanza("identity", len(identities), err)
+			}
+			identities = append(identities, li)
+		case "recipient-stanza":
+			if len(s.Args) < 2 {
+				return errors.New("malformed recipient stanza")
+			}
+			idx, err := strconv.Atoi(s.Args[0])
+			if err != nil {
+				return errors.New("malformed recipient stanza")
+			}
+			if _, ok := files[idx]; !ok {
+				order = append(order, idx)
+			}
+			files[idx] = append(files[idx], &age.Stanza{Type: s.Args[1], Args: s.Args[2:], Body: s.Body})
+		case "done":
+			break Phase1
+		}
+	}
+
+	// Phase 2: unwrap what we can, or report the first error.
+	if firstErr != nil {
+		return command(r, out, firstErr)
+	}
+	for _, idx := range order {
+		for _, li := range identities {
+			fk, err := li.Unwrap(files[idx])
+			if errors.Is(err, age.ErrIncorrectIdentity) {
+				continue
+			}
+			if err != nil {
+				if err := command(r, out, errorStanza("stanza", idx, err)); err != nil {
+					return err
+				}
+				break
+			}
+			if err := command(r, out, &age.Stanza{Type: "file-key", Args: []string{strconv.Itoa(idx)}, Body: fk}); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return writeStanza(out, &age.Stanza{Type: "done"})
+}
+
+func errorStanza(kind string, idx int, err error) *age.Stanza {
+	args := []string{kind, strconv.Itoa(idx)}
+	if kind == "stanza" {
+		args = append(args, "0")
+	}
+	return &age.Stanza{Type: "error", Args: args, Body: []byte(err.Error())}
+}
+
+// command sends a phase 2 stanza and waits for the client to acknowledge it.
+func command(r *bufio.Reader, w io.Writer, s *age.Stanza) error {
+	if err := writeStanza(w, s); err != nil {
+		return err
+	}
+	resp, err := readStanza(r)
+	if err != nil {
+		return err
+	}
+	switch resp.Type {
+	case "ok", "unsupported":
+		return nil
+	case "fail":
+		return fmt.Errorf("client rejected %s", s.Type)
+	default:
+		return fmt.Errorf("unexpected response %s", resp.Type)
+	}
+}
+
+// The plugin protocol uses the stanza encoding of the age header: an
+// argument line prefixed by "->", and a body of base64 lines of 64 columns
+// terminated by a shorter (possibly empty) line.
+const columnsPerLine = 64
+
+var b64 = base64.RawStdEncoding.Strict()
+
+func readStanza(r *bufio.Reader) (*age.Stanza, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(strings.TrimSuffix(line, "\n"))
+	if len(fields) < 2 || fields[0] != "->" {
+		return nil, fmt.Errorf("malformed stanza line: %q", line)
+	}
+	s := &age.Stanza{Type: fields[1], Args: fields[2:]}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		b, err := b64.DecodeString(line)
+		if err != nil {
+			return nil, err
+		}
+		s.Body = append(s.Body, b...)
+		if len(line) < columnsPerLine {
+			return s, nil
+		}
+	}
+}
+
+func writeStanza(w io.Writer, s *age.Stanza) error {
+	line := strings.Join(append([]string{"->", s.Type}, s.Args...), " ")
+	if _, err := io.WriteString(w, line+"\n"); err != nil {
+		return err
+	}
+	body := b64.EncodeToString(s.Body)
+	for len(body) >= columnsPerLine {
+		if _, err := io.WriteString(w, body[:columnsPerLine]+"\n"); err != nil {
+			return err
+		}
+		body = body[columnsPerLine:]
+	}
+	_, err := io.WriteString(w, body+"\n")
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// runPlugin drives a state machine over pipes as the age client would,
+// sending phase 1 and acknowledging each phase 2 command. It returns the
+// commands the plugin sent.
+func runPlugin(t *testing.T, sm func(io.Reader, io.Writer) error, phase1 []*age.Stanza) []*age.Stanza {
+	t.Helper()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := sm(inR, outW)
+		// the client's writes fail, rather than wait, once the plugin exits.
+		inR.Close()
+		outW.Close()
+		errc <- err
+	}()
+
+	go func() {
+		for _, s := range append(phase1, &age.Stanza{Type: "done"}) {
+			if err := writeStanza(inW, s); err != nil {
+				return
+			}
+		}
+	}()
+
+	var got []*age.Stanza
+	r := bufio.NewReader(outR)
+	for {
+		s, err := readStanza(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if s.Type == "done" {
+			break
+		}
+		got = append(got, s)
+		if err := writeStanza(inW, &age.Stanza{Type: "ok"}); err != nil {
+			break
+		}
+		if s.Type == "error" {
+			// the client gives up on an error.
+			inW.Close()
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("plugin failed: %v", err)
+	}
+	return got
+}
+
+func newKey(t *testing.T) (identity, recipient string) {
+	t.Helper()
+	sk, pk, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skb, err := crypto.MarshalPrivateKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkb, err := crypto.MarshalPublicKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plugin.EncodeIdentity(pluginName, skb), plugin.EncodeRecipient(pluginName, pkb)
+}
+
+func TestRecipientIdentity(t *testing.T) {
+	identity, recipient := newKey(t)
+	fileKey := bytes.Repeat([]byte{7}, 16)
+
+	wrapped := runPlugin(t, recipientV1, []*age.Stanza{
+		{Type: "add-recipient", Args: []string{recipient}},
+		{Type: "wrap-file-key", Body: fileKey},
+	})
+	if len(wrapped) == 0 {
+		t.Fatal("no stanzas wrapped")
+	}
+	phase1 := []*age.Stanza{{Type: "add-identity", Args: []string{identity}}}
+	for _, s := range wrapped {
+		if s.Type != "recipient-stanza" || s.Args[0] != "0" {
+			t.Fatalf("unexpected %s %v", s.Type, s.Args)
+		}
+		phase1 = append(phase1, s)
+	}
+
+	unwrapped := runPlugin(t, identityV1, phase1)
+	if len(unwrapped) != 1 || unwrapped[0].Type != "file-key" {
+		t.Fatalf("got %v, want a file key", unwrapped)
+	}
+	if !bytes.Equal(unwrapped[0].Body, fileKey) {
+		t.Fatalf("unwrapped %x, want %x", unwrapped[0].Body, fileKey)
+	}
+}
+
+func TestWrongIdentity(t *testing.T) {
+	_, recipient := newKey(t)
+	other, _ := newKey(t)
+	wrapped := runPlugin(t, recipientV1, []*age.Stanza{
+		{Type: "add-recipient", Args: []string{recipient}},
+		{Type: "wrap-file-key", Body: make([]byte, 16)},
+	})
+	phase1 := append([]*age.Stanza{{Type: "add-identity", Args: []string{other}}}, wrapped...)
+	if got := runPlugin(t, identityV1, phase1); len(got) != 0 {
+		t.Fatalf("got %s from the wrong identity", got[0].Type)
+	}
+}
+
+// bad identities are reported once the client has sent all of phase 1.
+func TestBadIdentity(t *testing.T) {
+	bad := plugin.EncodeIdentity(pluginName, []byte("not a key"))
+	for name, sm := range map[string]func(io.Reader, io.Writer) error{
+		"recipient": recipientV1,
+		"identity":  identityV1,
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := runPlugin(t, sm, []*age.Stanza{
+				{Type: "add-identity", Args: []string{bad}},
+				{Type: "wrap-file-key", Body: make([]byte, 16)},
+				{Type: "recipient-stanza", Args: []string{"0", "X25519", "arg"}, Body: make([]byte, 32)},
+			})
+			if len(got) != 1 || got[0].Type != "error" {
+				t.Fatalf("got %v, want one error", got)
+			}
+			if args := strings.Join(got[0].Args, " "); args != "identity 0" {
+				t.Fatalf("error args %q, want %q", args, "identity 0")
+			}
+		})
+	}
+}
@@ -15,17 +15,32 @@ import (
 )
 
 func NewLibP2PRecipient(p peer.ID) *LibP2PRecipient {
-	return &LibP2PRecipient{p}
+	return &LibP2PRecipient{p, nil}
+}
+
+// NewLibP2PRecipientFromKey is needed for key types (RSA, ECDSA) that are
+// too large to be inlined in their peer ID.
+func NewLibP2PRecipientFromKey(pk crypto.PubKey) (*LibP2PRecipient, error) {
+	pid, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	return &LibP2PRecipient{pid, pk}, nil
 }
 
 type LibP2PRecipient struct {
 	theirPubKey peer.ID
+	theirKey    crypto.PubKey
 }
 
 func (r *LibP2PRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
-	actualLibP2PKey, err := r.theirPubKey.ExtractPublicKey()
-	if err != nil {
-		return nil, err
+	actualLibP2PKey := r.theirKey
+	if actualLibP2PKey == nil {
+		var err error
+		actualLibP2PKey, err = r.theirPubKey.ExtractPublicKey()
+		if err != nil {
+			return nil, err
+		}
 	}
 	actualKey, err := crypto.PubKeyToStdKey(actualLibP2PKey)
 	if err != nil {
@@ -45,21 +60,16 @@ func (r *LibP2PRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
 		return ageR.Wrap(fileKey)
 
 	case *ecdsa.PublicKey:
-		return nil, fmt.Errorf("TODO: ecdsa not currently supported")
+		return wrapP256(p, fileKey)
 
-	case *ed25519.PublicKey, ed25519.PublicKey:
-		sshp, err := ssh.NewPublicKey(p)
-		if err != nil {
-			return nil, err
-		}
-		ageR, err := agessh.NewEd25519Recipient(sshp)
-		if err != nil {
-			return nil, err
-		}
-		return ageR.Wrap(fileKey)
+	case ed25519.PublicKey:
+		return wrapX25519(p, fileKey)
+
+	case *ed25519.PublicKey:
+		return wrapX25519(*p, fileKey)
 
-	case *secp256k1.PublicKey:
-		return nil, fmt.Errorf("TODO: secp256k1 not currently supported")
+	case *crypto.Secp256k1PublicKey:
+		return wrapSecp256k1((*secp256k1.PublicKey)(p), fileKey)
 
 	default:
 		return nil, fmt.Errorf("unsupported key type: %T", p)
@@ -0,0 +1,109 @@
+package agep2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+var keyTypes = []struct {
+	name string
+	typ  int
+	bits int
+}{
+	{"ed25519", crypto.Ed25519, -1},
+	{"rsa", crypto.RSA, 2048},
+	{"ecdsa", crypto.ECDSA, -1},
+	{"secp256k1", crypto.Secp256k1, -1},
+}
+
+func newIdentity(t *testing.T, typ, bits int) (*LibP2PIdentity, *LibP2PRecipient) {
+	t.Helper()
+	sk, _, err := crypto.GenerateKeyPair(typ, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := NewLibP2PIdentity(sk)
+	r, err := id.Recipient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, r
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	for _, kt := range keyTypes {
+		t.Run(kt.name, func(t *testing.T) {
+			id, r := newIdentity(t, kt.typ, kt.bits)
+			fileKey := make([]byte, 16)
+			if _, err := rand.Read(fileKey); err != nil {
+				t.Fatal(err)
+			}
+			stanzas, err := r.Wrap(fileKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := id.Unwrap(stanzas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, fileKey) {
+				t.Fatalf("unwrapped %x, want %x", got, fileKey)
+			}
+		})
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	for _, kt := range keyTypes {
+		t.Run(kt.name, func(t *testing.T) {
+			id, rcpt := newIdentity(t, kt.typ, kt.bits)
+			msg := []byte("a libp2p key can be an age recipient")
+
+			var buf bytes.Buffer
+			w, err := age.Encrypt(&buf, rcpt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := age.Decrypt(&buf, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("decrypted %q, want %q", got, msg)
+			}
+		})
+	}
+}
+
+func TestWrongIdentity(t *testing.T) {
+	for _, kt := range keyTypes {
+		t.Run(kt.name, func(t *testing.T) {
+			_, r := newIdentity(t, kt.typ, kt.bits)
+			other, _ := newIdentity(t, kt.typ, kt.bits)
+			stanzas, err := r.Wrap(make([]byte, 16))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := other.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+				t.Fatalf("got %v, want %v", err, age.ErrIncorrectIdentity)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package agep2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Stanza types for the ECIES-style wrapping of file keys to the elliptic
+// curve key types libp2p supports. Each stanza carries the compressed
+// ephemeral public key as its single argument and the wrapped file key as
+// its body.
+const (
+	P256StanzaType      = "libp2p-p256"
+	Secp256k1StanzaType = "libp2p-secp256k1"
+
+	p256Label      = "age-encryption.org/v1/libp2p-p256"
+	secp256k1Label = "age-encryption.org/v1/libp2p-secp256k1"
+
+	fileKeySize = 16
+)
+
+var b64 = base64.RawStdEncoding.Strict()
+
+func wrapP256(theirKey *ecdsa.PublicKey, fileKey []byte) ([]*age.Stanza, error) {
+	if theirKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("unsupported ecdsa curve: %s", theirKey.Curve.Params().Name)
+	}
+	theirECDH, err := theirKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralECDH, err := ephemeral.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeralECDH.ECDH(theirECDH)
+	if err != nil {
+		return nil, err
+	}
+	ourPub := elliptic.MarshalCompressed(elliptic.P256(), ephemeral.X, ephemeral.Y)
+	theirPub := elliptic.MarshalCompressed(elliptic.P256(), theirKey.X, theirKey.Y)
+	return wrapStanza(P256StanzaType, p256Label, shared, ourPub, theirPub, fileKey)
+}
+
+func unwrapP256(ourKey *ecdsa.PrivateKey, stanzas []*age.Stanza) ([]byte, error) {
+	ourECDH, err := ourKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	ourPub := elliptic.MarshalCompressed(elliptic.P256(), ourKey.X, ourKey.Y)
+	return unwrapStanzas(stanzas, P256StanzaType, func(s *age.Stanza) ([]byte, error) {
+		theirPub, err := stanzaArg(s)
+		if err != nil {
+			return nil, err
+		}
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), theirPub)
+		if x == nil {
+			return nil, errors.New("invalid libp2p-p256 ephemeral key")
+		}
+		ephemeral, err := (&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}).ECDH()
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ourECDH.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		return unwrapStanza(p256Label, shared, theirPub, ourPub, s.Body)
+	})
+}
+
+func wrapSecp256k1(theirKey *secp256k1.PublicKey, fileKey []byte) ([]*age.Stanza, error) {
+	ephemeral, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	shared := secp256k1.GenerateSharedSecret(ephemeral, theirKey)
+	ourPub := ephemeral.PubKey().SerializeCompressed()
+	return wrapStanza(Secp256k1StanzaType, secp256k1Label, shared, ourPub, theirKey.SerializeCompressed(), fileKey)
+}
+
+func unwrapSecp256k1(ourKey *secp256k1.PrivateKey, stanzas []*age.Stanza) ([]byte, error) {
+	ourPub := ourKey.PubKey().SerializeCompressed()
+	return unwrapStanzas(stanzas, Secp256k1StanzaType, func(s *age.Stanza) ([]byte, error) {
+		theirPub, err := stanzaArg(s)
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := secp256k1.ParsePubKey(theirPub)
+		if err != nil {
+			return nil, err
+		}
+		shared := secp256k1.GenerateSharedSecret(ourKey, ephemeral)
+		return unwrapStanza(secp256k1Label, shared, theirPub, ourPub, s.Body)
+	})
+}
+
+// wrapStanza seals the file key under a key derived from the ECDH shared
+// secret, bound to both the ephemeral and recipient public keys, mirroring
+// the construction of age's native X25519 stanza.
+func wrapStanza(typ, label string, shared, ephemeralPub, theirPub, fileKey []byte) ([]*age.Stanza, error) {
+	wrapped, err := aeadSeal(deriveWrappingKey(label, shared, ephemeralPub, theirPub), fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return []*age.Stanza{{
+		Type: typ,
+		Args: []string{b64.EncodeToString(ephemeralPub)},
+		Body: wrapped,
+	}}, nil
+}
+
+func unwrapStanza(label string, shared, ephemeralPub, ourPub, body []byte) ([]byte, error) {
+	if len(body) != fileKeySize+chacha20poly1305.Overhead {
+		return nil, errors.New("invalid stanza body length")
+	}
+	fileKey, err := aeadOpen(deriveWrappingKey(label, shared, ephemeralPub, ourPub), body)
+	if err != nil {
+		return nil, age.ErrIncorrectIdentity
+	}
+	return fileKey, nil
+}
+
+// unwrapStanzas tries each stanza of the given type in turn, returning
+// age.ErrIncorrectIdentity if none of them are addressed to us.
+func unwrapStanzas(stanzas []*age.Stanza, typ string, unwrap func(*age.Stanza) ([]byte, error)) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.Type != typ {
+			continue
+		}
+		fileKey, err := unwrap(s)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		}
+		return fileKey, err
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+func stanzaArg(s *age.Stanza) ([]byte, error) {
+	if len(s.Args) != 1 {
+		return nil, fmt.Errorf("invalid %s stanza", s.Type)
+	}
+	return b64.DecodeString(s.Args[0])
+}
+
+func deriveWrappingKey(label string, shared, ephemeralPub, recipientPub []byte) []byte {
+	salt := make([]byte, 0, len(ephemeralPub)+len(recipientPub))
+	salt = append(salt, ephemeralPub...)
+	salt = append(salt, recipientPub...)
+	h := hkdf.New(sha256.New, shared, salt, []byte(label))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func aeadSeal(key, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func aeadOpen(key, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -4,13 +4,13 @@ import (
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rsa"
+	"errors"
 	"fmt"
 
 	"filippo.io/age"
 	"filippo.io/age/agessh"
 	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 	"github.com/libp2p/go-libp2p/core/crypto"
-	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 func NewLibP2PIdentity(pk crypto.PrivKey) *LibP2PIdentity {
@@ -21,12 +21,8 @@ type LibP2PIdentity struct {
 	myPrivKey crypto.PrivKey
 }
 
-func (li *LibP2PIdentity) Recipient() *LibP2PRecipient {
-	pid, err := peer.IDFromPrivateKey(li.myPrivKey)
-	if err != nil {
-		return nil
-	}
-	return NewLibP2PRecipient(pid)
+func (li *LibP2PIdentity) Recipient() (*LibP2PRecipient, error) {
+	return NewLibP2PRecipientFromKey(li.myPrivKey.GetPublic())
 }
 
 func (li *LibP2PIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
@@ -44,17 +40,22 @@ func (li *LibP2PIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
 		return sshp.Unwrap(stanzas)
 
 	case *ecdsa.PrivateKey:
-		return nil, fmt.Errorf("TODO: ecdsa not currently supported")
+		return unwrapP256(p, stanzas)
 
 	case *ed25519.PrivateKey:
+		fileKey, err := unwrapX25519(*p, stanzas)
+		if !errors.Is(err, age.ErrIncorrectIdentity) {
+			return fileKey, err
+		}
+		// fall back to ssh-ed25519 stanzas from older clients.
 		sshp, err := agessh.NewEd25519Identity(*p)
 		if err != nil {
 			return nil, err
 		}
 		return sshp.Unwrap(stanzas)
 
-	case *secp256k1.PrivateKey:
-		return nil, fmt.Errorf("TODO: secp256k1 not currently supported")
+	case *crypto.Secp256k1PrivateKey:
+		return unwrapSecp256k1((*secp256k1.PrivateKey)(p), stanzas)
 
 	default:
 		return nil, fmt.Errorf("unsupported key type")
@@ -0,0 +1,74 @@
+package agep2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+
+	"filippo.io/age"
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/curve25519"
+)
+
+// X25519StanzaType stanzas wrap file keys to the X25519 form of an Ed25519
+// libp2p key. Unlike ssh-ed25519 stanzas they carry no key fingerprint, so
+// queries to the same exit cannot be linked by their headers.
+const X25519StanzaType = "libp2p-x25519"
+
+const x25519Label = "age-encryption.org/v1/libp2p-x25519"
+
+func ed25519PublicKeyToCurve25519(pk ed25519.PublicKey) ([]byte, error) {
+	p, err := new(edwards25519.Point).SetBytes(pk)
+	if err != nil {
+		return nil, err
+	}
+	return p.BytesMontgomery(), nil
+}
+
+func ed25519PrivateKeyToCurve25519(pk ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(pk.Seed())
+	return h[:curve25519.ScalarSize]
+}
+
+func wrapX25519(theirKey ed25519.PublicKey, fileKey []byte) ([]*age.Stanza, error) {
+	theirPub, err := ed25519PublicKeyToCurve25519(theirKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, err
+	}
+	ourPub, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, theirPub)
+	if err != nil {
+		return nil, err
+	}
+	return wrapStanza(X25519StanzaType, x25519Label, shared, ourPub, theirPub, fileKey)
+}
+
+func unwrapX25519(ourKey ed25519.PrivateKey, stanzas []*age.Stanza) ([]byte, error) {
+	ourSecret := ed25519PrivateKeyToCurve25519(ourKey)
+	ourPub, err := curve25519.X25519(ourSecret, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapStanzas(stanzas, X25519StanzaType, func(s *age.Stanza) ([]byte, error) {
+		theirPub, err := stanzaArg(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(theirPub) != curve25519.PointSize {
+			return nil, errors.New("invalid libp2p-x25519 ephemeral key")
+		}
+		shared, err := curve25519.X25519(ourSecret, theirPub)
+		if err != nil {
+			return nil, err
+		}
+		return unwrapStanza(x25519Label, shared, theirPub, ourPub, s.Body)
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+// prefetchTTL is how long subresources pushed with a page are served from
+// the local store before being fetched again.
+const prefetchTTL = 5 * time.Minute
+
+// prefetchIndex maps the requests an exit answered ahead of time, by their
+// RequestCID, to the attested responses held in the local store.
+type prefetchIndex struct {
+	store   *gemipfs.CarStore
+	entries *expirable.LRU[cid.Cid, *gemipfs.Attestation]
+}
+
+func newPrefetchIndex(store *gemipfs.CarStore) *prefetchIndex {
+	return &prefetchIndex{
+		store:   store,
+		entries: expirable.NewLRU[cid.Cid, *gemipfs.Attestation](1024, nil, prefetchTTL),
+	}
+}
+
+// add fetches a bundle into the local store and records its entries. Only
+// entries attested by the exit that pushed the bundle are kept.
+func (pi *prefetchIndex) add(ctx context.Context, h host.Host, exit peer.ID, locs []gemipfs.Location, root cid.Cid) error {
+	keys, err := exitKeys(h, []peer.ID{exit})
+	if err != nil {
+		return err
+	}
+	carBytes, err := fetchBundle(ctx, h, locs, root)
+	if err != nil {
+		return err
+	}
+	if err := pi.store.Add(bytes.NewReader(carBytes)); err != nil {
+		return err
+	}
+	idx, err := pi.store.Get(root)
+	if err != nil {
+		return err
+	}
+	bundle, err := gemipfs.ParseBundle(idx)
+	if err != nil {
+		return err
+	}
+	for _, e := range bundle.Entries {
+		if err := e.Attestation.Verify(keys[0]); err != nil {
+			log.Printf("dropping bundle entry for %s: %v\n", e.Attestation.Resp, err)
+			continue
+		}
+		// the page itself is keyed by its query, not what it asks for.
+		if e.Attestation.Req.Defined() {
+			pi.entries.Add(e.Attestation.Req, e.Attestation)
+		}
+	}
+	return nil
+}
+
+// lookup answers a request from a previously pushed bundle.
+func (pi *prefetchIndex) lookup(req *http.Request, gr *gemipfs.Request) (*http.Response, bool) {
+	att, ok := pi.entries.Get(gr.RequestCID())
+	if !ok {
+		return nil, false
+	}
+	encResp, err := pi.store.Get(att.Resp)
+	if err != nil {
+		return nil, false
+	}
+	resp, err := gemipfs.ReadResponse(att.Req, bytes.NewReader(encResp))
+	if err != nil {
+		log.Printf("could not parse prefetched response for %s: %v\n", req.URL, err)
+		return nil, false
+	}
+	hResp, err := resp.HTTP(req)
+	if err != nil {
+		return nil, false
+	}
+	return hResp, true
+}
+
+// fetchBundle retrieves a bundle as a car from the first of the locations
+// that has it.
+func fetchBundle(ctx context.Context, h host.Host, locs []gemipfs.Location, root cid.Cid) ([]byte, error) {
+	if len(locs) == 0 {
+		return nil, errors.New("no repo locations for bundle")
+	}
+	var errs []error
+	for _, l := range locs {
+		b, err := fetchBundleFrom(ctx, h, l, root)
+		if err == nil {
+			err = checkBundle(b, root)
+		}
+		if err == nil {
+			return b, nil
+		}
+		log.Printf("could not get bundle from %s: %v\n", l, err)
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// checkBundle checks a bundle's car is rooted at the bundle asked for, and
+// that each of its blocks is what its cid says, since the local store trusts
+// what it is given.
+func checkBundle(b []byte, root cid.Cid) error {
+	br, err := car.NewBlockReader(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if len(br.Roots) != 1 || !br.Roots[0].Equals(root) {
+		return fmt.Errorf("bundle car is not rooted at %s", root)
+	}
+	for {
+		if _, err := br.Next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func fetchBundleFrom(ctx context.Context, h host.Host, l gemipfs.Location, root cid.Cid) ([]byte, error) {
+	if l.IsLibP2P() {
+		return fetchBundleBlocks(ctx, h, l, root)
+	}
+	u, err := l.URL()
+	if err != nil {
+		return nil, err
+	}
+	u = u.JoinPath("ipfs", root.String())
+	u.RawQuery = "format=car&dag-scope=all"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", gemipfs.CarContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("repo responded %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fetchBundleBlocks gets the blocks of a bundle one at a time, for repos
+// only reachable over libp2p, and packs them into a car.
+func fetchBundleBlocks(ctx context.Context, h host.Host, l gemipfs.Location, root cid.Cid) ([]byte, error) {
+	idx, err := fetchFrom(ctx, h, l, root)
+	if err != nil {
+		return nil, err
+	}
+	links, err := gemipfs.DagJSONLinks(idx)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(nil)
+	cw, err := storage.NewWritable(buf, []cid.Cid{root}, car.WriteAsCarV1(true))
+	if err != nil {
+		return nil, err
+	}
+	if err := cw.Put(ctx, root.KeyString(), idx); err != nil {
+		return nil, err
+	}
+	seen := make(map[cid.Cid]struct{})
+	for _, c := range links {
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		b, err := fetchFrom(ctx, h, l, c)
+		if err != nil {
+			return nil, err
+		}
+		if err := cw.Put(ctx, c.KeyString(), b); err != nil {
+			return nil, err
+		}
+	}
+	if err := cw.Finalize(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
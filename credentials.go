@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+)
+
+// credentialAction is what the proxy does with requests to a site that may
+// carry the browser's cookies and credentials.
+type credentialAction int
+
+const (
+	// credStrip drops credentials from requests, and cookies from responses,
+	// so browsing is anonymous and responses can be shared.
+	credStrip credentialAction = iota
+	// credPrivate sends credentials through an exit. The response is only
+	// for this client, and is never cached or stored in a repo.
+	credPrivate
+	// credDirect bypasses gemipfs, connecting to the site directly.
+	credDirect
+)
+
+// credentialPolicy picks the action for each site. Sites not listed have
+// their credentials stripped, which is safe for shared caching.
+type credentialPolicy struct {
+	private []string
+	direct  []string
+}
+
+func newCredentialPolicy(private, direct string) *credentialPolicy {
+	return &credentialPolicy{
+		private: parseDomains(private),
+		direct:  parseDomains(direct),
+	}
+}
+
+func parseDomains(s string) []string {
+	var domains []string
+	for _, d := range strings.Split(s, ",") {
+		if d = normalizeHost(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+func normalizeHost(h string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")
+}
+
+func matchesDomain(host string, domains []string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// action is what to do with a request to host. A site listed as both
+// direct and private is connected to directly.
+func (cp *credentialPolicy) action(host string) credentialAction {
+	host = normalizeHost(host)
+	switch {
+	case matchesDomain(host, cp.direct):
+		return credDirect
+	case matchesDomain(host, cp.private):
+		return credPrivate
+	}
+	return credStrip
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/sec"
+	"github.com/multiformats/go-multiaddr"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+// parseExitAddr reads an exit as a multiaddr, which pins the exit's peer ID
+// when it ends in /p2p/, or as a legacy host:port. The returned ID is empty
+// if the exit isn't pinned.
+func parseExitAddr(s string) (*peer.AddrInfo, error) {
+	if !strings.HasPrefix(s, "/") {
+		h, p, err := net.SplitHostPort(s)
+		if err != nil {
+			return nil, err
+		}
+		proto := "dns"
+		if ip, err := netip.ParseAddr(h); err == nil {
+			proto = "ip4"
+			if ip.Is6() {
+				proto = "ip6"
+			}
+		}
+		s = fmt.Sprintf("/%s/%s/tcp/%s", proto, h, p)
+	}
+	ma, err := multiaddr.NewMultiaddr(s)
+	if err != nil {
+		return nil, err
+	}
+	transport, id := peer.SplitAddr(ma)
+	ai := peer.AddrInfo{ID: id}
+	if transport != nil {
+		ai.Addrs = []multiaddr.Multiaddr{transport}
+	}
+	return &ai, nil
+}
+
+// connectToExit dials an exit, checking it is the peer it is pinned to.
+// Exits without a pinned ID are only accepted with a known exits record, in
+// which case the ID learned on first contact is pinned from then on.
+func connectToExit(ctx context.Context, h host.Host, addr string, known *knownExits) (peer.ID, error) {
+	ai, err := parseExitAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	id, err := identifyExit(ctx, h, addr, ai, known)
+	if err != nil {
+		return "", err
+	}
+	// the addresses learned from the connection expire once it closes, but
+	// the health checks must be able to re-dial a configured exit after any
+	// outage.
+	h.Peerstore().AddAddrs(id, ai.Addrs, peerstore.PermanentAddrTTL)
+	return id, nil
+}
+
+// identifyExit connects to the exit at ai, returning the peer it is.
+func identifyExit(ctx context.Context, h host.Host, addr string, ai *peer.AddrInfo, known *knownExits) (peer.ID, error) {
+	if ai.ID != "" {
+		return ai.ID, h.Connect(ctx, *ai)
+	}
+	if known == nil {
+		return "", fmt.Errorf("exit %s has no /p2p/ peer id; pin one or trust it on first use", addr)
+	}
+	if id, ok := known.get(addr); ok {
+		ai.ID = id
+		err := h.Connect(ctx, *ai)
+		var mismatch sec.ErrPeerIDMismatch
+		if errors.As(err, &mismatch) {
+			if err := followRotation(ctx, h, *ai, mismatch.Actual); err == nil {
+				log.Printf("exit %s rotated from %s to %s\n", addr, id, mismatch.Actual)
+				return mismatch.Actual, known.add(addr, mismatch.Actual)
+			}
+			log.Printf("WARNING: exit %s is now %s, not the known %s. It may be impersonated; remove it from %s if the change is expected.\n",
+				addr, mismatch.Actual, id, known.path)
+			return "", fmt.Errorf("peer id of exit %s changed", addr)
+		}
+		return id, err
+	}
+
+	id, err := learnPeerID(ctx, h, *ai)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("trusting exit %s as %s on first use\n", addr, id)
+	if err := known.add(addr, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// followRotation accepts a new identity at a known exit if the exit can
+// show signed handoffs to it from the identity it was pinned to.
+func followRotation(ctx context.Context, h host.Host, ai peer.AddrInfo, actual peer.ID) error {
+	pinned := ai.ID
+	ai.ID = actual
+	if err := h.Connect(ctx, ai); err != nil {
+		return err
+	}
+	handoffs, err := gemipfs.FetchHandoffs(ctx, h, actual)
+	if err != nil {
+		return err
+	}
+	return gemipfs.FollowHandoffs(handoffs, pinned, actual)
+}
+
+// learnPeerID finds who is listening at an address by dialing a random peer
+// ID and reading the real one from the failed handshake. It authenticates
+// nothing, and is only used on first contact.
+func learnPeerID(ctx context.Context, h host.Host, ai peer.AddrInfo) (peer.ID, error) {
+	_, fakePub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	if ai.ID, err = peer.IDFromPublicKey(fakePub); err != nil {
+		return "", err
+	}
+	err = h.Connect(ctx, ai)
+	var mismatch sec.ErrPeerIDMismatch
+	if !errors.As(err, &mismatch) {
+		if err == nil {
+			err = errors.New("handshake succeeded with a random peer id")
+		}
+		return "", err
+	}
+	ai.ID = mismatch.Actual
+	return ai.ID, h.Connect(ctx, ai)
+}
+
+// knownExits persists the peer IDs learned for unpinned exits, one
+// "address peerID" pair per line. Later lines replace earlier ones.
+type knownExits struct {
+	path string
+
+	mtx sync.Mutex
+	ids map[string]peer.ID
+}
+
+func loadKnownExits(path string) (*knownExits, error) {
+	k := &knownExits{path: path, ids: make(map[string]peer.ID)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		id, err := peer.Decode(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad peer id for %s in %s: %w", fields[0], path, err)
+		}
+		k.ids[fields[0]] = id
+	}
+	return k, s.Err()
+}
+
+func (k *knownExits) get(addr string) (peer.ID, bool) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	id, ok := k.ids[addr]
+	return id, ok
+}
+
+func (k *knownExits) add(addr string, id peer.ID) error {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	k.ids[addr] = id
+	if err := os.MkdirAll(filepath.Dir(k.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s %s\n", addr, id)
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+// discovery keeps the exits announced on pubsub that are authorized by one
+// of the pinned services.
+type discovery struct {
+	h        host.Host
+	services []string
+
+	mtx   sync.Mutex
+	exits map[peer.ID]*gemipfs.ExitAnnouncement
+}
+
+func startDiscovery(ctx context.Context, h host.Host, services []string, bootstrap string) (*discovery, error) {
+	for _, b := range strings.Split(bootstrap, ",") {
+		if b == "" {
+			continue
+		}
+		ai, err := peer.AddrInfoFromString(b)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.Connect(ctx, *ai); err != nil {
+			log.Printf("could not connect to bootstrap peer %s: %v\n", b, err)
+		}
+	}
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	topic, err := gemipfs.JoinExitTopic(ps)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+	d := &discovery{
+		h:        h,
+		services: services,
+		exits:    make(map[peer.ID]*gemipfs.ExitAnnouncement),
+	}
+	go d.run(ctx, sub)
+	return d, nil
+}
+
+func (d *discovery) run(ctx context.Context, sub *pubsub.Subscription) {
+	defer sub.Cancel()
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		a, err := gemipfs.ParseExitAnnouncement(msg.Data)
+		if err != nil {
+			continue
+		}
+		d.add(a)
+	}
+}
+
+func (d *discovery) add(a *gemipfs.ExitAnnouncement) {
+	service, err := a.Authorized(d.services, time.Now())
+	if err != nil {
+		log.Printf("ignoring exit %s: %v\n", a.Peer, err)
+		return
+	}
+	ai, err := a.AddrInfo()
+	if err != nil {
+		return
+	}
+	d.h.Peerstore().AddAddrs(ai.ID, ai.Addrs, time.Until(a.Expires))
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.exits[a.Peer]; !ok {
+		log.Printf("discovered exit %s authorized by %s\n", a.Peer, service)
+	}
+	d.exits[a.Peer] = a
+}
+
+// Delegation is the cid of the delegation a discovered exit was trusted for.
+func (d *discovery) Delegation(e peer.ID) (cid.Cid, bool) {
+	d.mtx.Lock()
+	a, ok := d.exits[e]
+	d.mtx.Unlock()
+	if !ok || len(a.Delegation) == 0 {
+		return cid.Undef, false
+	}
+	u, err := gemipfs.ParseUCAN(a.Delegation[0])
+	if err != nil {
+		return cid.Undef, false
+	}
+	return u.CID(), true
+}
+
+// Exits lists the live discovered exits that can serve queries with the
+// given capabilities.
+func (d *discovery) Exits(caps ...string) []peer.ID {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	now := time.Now()
+	exits := make([]peer.ID, 0, len(d.exits))
+outer:
+	for p, a := range d.exits {
+		if !now.Before(a.Expires) {
+			delete(d.exits, p)
+			continue
+		}
+		for _, c := range caps {
+			if !a.Can(c) {
+				continue outer
+			}
+		}
+		exits = append(exits, p)
+	}
+	sort.Slice(exits, func(i, j int) bool { return exits[i] < exits[j] })
+	return exits
+}
+
+// requiredCaps are the capabilities an exit needs to deliver to the repos.
+func requiredCaps(repos []gemipfs.Location) []string {
+	if len(repos) == 0 {
+		return []string{gemipfs.CapDirect}
+	}
+	var caps []string
+	for _, r := range repos {
+		c := gemipfs.CapStoreHTTP
+		if r.IsLibP2P() {
+			c = gemipfs.CapStoreLibP2P
+		}
+		if len(caps) == 0 || caps[len(caps)-1] != c {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// appendNew adds the exits not already in the list.
+func appendNew(exits []peer.ID, more ...peer.ID) []peer.ID {
+	out := append([]peer.ID{}, exits...)
+	for _, m := range more {
+		if !slices.Contains(out, m) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+const exitProtocol = "/exit/0.0.1"
+
+// exitKeys collects the public keys to encrypt queries to. Keys learned
+// during the handshake are preferred, since RSA and ECDSA keys can't be
+// recovered from a peer ID.
+func exitKeys(h host.Host, exits []peer.ID) ([]crypto.PubKey, error) {
+	keys := make([]crypto.PubKey, 0, len(exits))
+	for _, e := range exits {
+		pk := h.Peerstore().PubKey(e)
+		if pk == nil {
+			var err error
+			pk, err = e.ExtractPublicKey()
+			if err != nil {
+				return nil, fmt.Errorf("no key known for exit %s: %w", e, err)
+			}
+		}
+		keys = append(keys, pk)
+	}
+	return keys, nil
+}
+
+// authorizedExits filters exits down to those holding a UCAN delegation
+// from one of the pinned services, along with the cid of the delegation each
+// must attest under.
+func authorizedExits(ctx context.Context, h host.Host, exits []peer.ID, services []string) ([]peer.ID, map[peer.ID]cid.Cid) {
+	ok := make([]peer.ID, 0, len(exits))
+	delegations := make(map[peer.ID]cid.Cid, len(exits))
+	for _, e := range exits {
+		chain, err := exitDelegation(ctx, h, e)
+		if err != nil {
+			log.Printf("could not get delegation of exit %s: %v\n", e, err)
+			continue
+		}
+		a := gemipfs.ExitAnnouncement{Peer: e}
+		for _, u := range chain {
+			a.Delegation = append(a.Delegation, u.String())
+		}
+		if _, err := a.Authorized(services, time.Now()); err != nil {
+			log.Printf("exit %s is not authorized: %v\n", e, err)
+			continue
+		}
+		ok = append(ok, e)
+		delegations[e] = chain[0].CID()
+	}
+	return ok, delegations
+}
+
+func exitDelegation(ctx context.Context, h host.Host, e peer.ID) ([]*gemipfs.UCAN, error) {
+	s, err := h.NewStream(ctx, e, gemipfs.ExitAuthProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	stop := context.AfterFunc(ctx, func() { s.Reset() })
+	defer stop()
+	b, err := io.ReadAll(io.LimitReader(s, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return gemipfs.ParseUCANChain(b)
+}
+
+func askExit(ctx context.Context, h host.Host, e peer.ID, q *gemipfs.Query, sk *gemipfs.SessionKey) (*gemipfs.Reply, error) {
+	stream, err := h.NewStream(ctx, e, exitProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stop := context.AfterFunc(ctx, func() { stream.Reset() })
+	defer stop()
+	if err := q.Write(stream); err != nil {
+		return nil, err
+	}
+	stream.CloseWrite()
+
+	ioR, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, fmt.Errorf("did not get attestation response: %w", err)
+	}
+	if len(ioR) == 0 {
+		return nil, errors.New("no attestation response")
+	}
+	if sk == nil {
+		return gemipfs.ReadLegacyReply(ioR)
+	}
+	reply, err := gemipfs.OpenReply(sk, ioR)
+	if err != nil {
+		return nil, err
+	}
+	if err := reply.Err(); err != nil {
+		return nil, err
+	}
+	if reply.Attestation == nil {
+		return nil, errors.New("reply is missing attestation")
+	}
+	return reply, nil
+}
+
+// checkAttestation checks that the attestation is signed by the exit, is
+// for the query sent, and, when the exit must be delegated to, is made under
+// the delegation it was trusted for.
+func checkAttestation(h host.Host, e peer.ID, q *gemipfs.Query, a *gemipfs.Attestation, delegation *cid.Cid) error {
+	keys, err := exitKeys(h, []peer.ID{e})
+	if err != nil {
+		return err
+	}
+	if err := a.Verify(keys[0]); err != nil {
+		return fmt.Errorf("bad attestation: %w", err)
+	}
+	if !a.Req.Equals(q.Resource) {
+		return fmt.Errorf("attestation is for %s, not %s", a.Req, q.Resource)
+	}
+	if delegation != nil && (a.Delegation == nil || !a.Delegation.Equals(*delegation)) {
+		return errors.New("attestation is not made under the exit's delegation")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// gemipfs-key manages the libp2p identities of the client, exits and repos.
+//
+//	gemipfs-key -identity <key file> id        print the peer ID (and DID)
+//	gemipfs-key -identity <key file> rotate    replace the key, recording a handoff
+//
+// Keys are created by the client, exits and repos on first use, not by this
+// tool, which only works with existing ones. They are age encrypted at rest when
+// GEMIPFS_IDENTITY_PASSPHRASE is set. A rotated peer keeps its previous key
+// to answer in-flight queries, and serves the handoffs so clients that
+// trusted the old peer ID can follow it.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+func main() {
+	identity := flag.String("identity", "exit.key", "libp2p identity file")
+	flag.Parse()
+
+	var err error
+	switch flag.Arg(0) {
+	case "id":
+		err = printID(*identity)
+	case "rotate":
+		err = rotate(*identity)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func printID(identity string) error {
+	sk, err := gemipfs.LoadIdentity(identity)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no identity at %s", identity)
+	} else if err != nil {
+		return err
+	}
+	id, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return err
+	}
+	fmt.Println(id)
+	if did, err := gemipfs.DIDFromPubKey(sk.GetPublic()); err == nil {
+		fmt.Println(did)
+	}
+	return nil
+}
+
+func rotate(identity string) error {
+	h, err := gemipfs.RotateIdentity(identity)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rotated %s to %s; restart to use it\n", h.From, h.To)
+	return nil
+}
@@ -0,0 +1,134 @@
+package gemipfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Exits announce themselves on a gossipsub topic. Messages are signed by
+// the exit's peer key, so an announcement can only speak for its author.
+const ExitTopic = "/gemipfs/exits/0.0.1"
+
+// Capabilities an exit may announce.
+const (
+	// CapDirect exits can deliver responses on the query stream.
+	CapDirect = "direct"
+	// CapStoreHTTP exits can store responses at HTTP repos.
+	CapStoreHTTP = "store-http"
+	// CapStoreLibP2P exits can store responses at libp2p repos.
+	CapStoreLibP2P = "store-libp2p"
+)
+
+type ExitAnnouncement struct {
+	Peer         peer.ID
+	Addrs        []string
+	Capabilities []string
+	// TokenIssuer is the privacy pass issuer the exit redeems tokens from.
+	TokenIssuer string `json:",omitempty"`
+	// Delegation is the exit's UCAN chain, leaf first.
+	Delegation []string
+	Expires    time.Time
+}
+
+func (a *ExitAnnouncement) Bytes() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+func ParseExitAnnouncement(b []byte) (*ExitAnnouncement, error) {
+	a := ExitAnnouncement{}
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// AddrInfo is where the exit can be dialed.
+func (a *ExitAnnouncement) AddrInfo() (*peer.AddrInfo, error) {
+	ai := peer.AddrInfo{ID: a.Peer}
+	for _, s := range a.Addrs {
+		ma, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, err
+		}
+		ai.Addrs = append(ai.Addrs, ma)
+	}
+	return &ai, nil
+}
+
+func (a *ExitAnnouncement) Can(capability string) bool {
+	for _, c := range a.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorized checks the announcement's delegation against the pinned
+// services, returning the one it is authorized by. An authorized
+// announcement's Expires is cut to when its delegation expires, so the exit
+// isn't trusted for longer than it was delegated for.
+func (a *ExitAnnouncement) Authorized(services []string, now time.Time) (string, error) {
+	chain := make([]*UCAN, 0, len(a.Delegation))
+	for _, d := range a.Delegation {
+		u, err := ParseUCAN(d)
+		if err != nil {
+			return "", err
+		}
+		chain = append(chain, u)
+	}
+	var errs []error
+	for _, s := range services {
+		err := VerifyExitDelegation(chain, s, a.Peer, now)
+		if err == nil {
+			for _, u := range chain {
+				if !u.Expiry.IsZero() && u.Expiry.Before(a.Expires) {
+					a.Expires = u.Expiry
+				}
+			}
+			return s, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return "", errors.New("no trusted services")
+	}
+	return "", errors.Join(errs...)
+}
+
+// JoinExitTopic joins the announcement topic, dropping announcements that
+// are malformed, expired, or not from the exit they describe. Whether the
+// exit is trusted is left to the subscriber.
+func JoinExitTopic(ps *pubsub.PubSub) (*pubsub.Topic, error) {
+	err := ps.RegisterTopicValidator(ExitTopic, func(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+		a, err := ParseExitAnnouncement(msg.Data)
+		if err != nil {
+			return false
+		}
+		return validAnnouncement(a, msg.GetFrom(), time.Now()) == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ps.Join(ExitTopic)
+}
+
+func validAnnouncement(a *ExitAnnouncement, author peer.ID, now time.Time) error {
+	if a.Peer != author {
+		return fmt.Errorf("announcement for %s sent by %s", a.Peer, author)
+	}
+	if !now.Before(a.Expires) {
+		return errors.New("announcement has expired")
+	}
+	if _, err := a.AddrInfo(); err != nil {
+		return err
+	}
+	return nil
+}
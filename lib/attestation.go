@@ -3,6 +3,7 @@ package gemipfs
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 
@@ -12,24 +13,56 @@ import (
 
 type Attester struct {
 	Identity crypto.PrivKey
+	// Delegation is the exit's UCAN chain, leaf first, if it has one.
+	Delegation []*UCAN
 }
 
 type Attestation struct {
 	Req  cid.Cid
 	Resp cid.Cid
 	Sig  []byte
+	// Locations lists where the exit managed to store the response. They
+	// are a retrieval hint and are not covered by the signature.
+	Locations []Location `json:",omitempty"`
+	// Delegation is the CID of the UCAN authorizing the exit, and is
+	// covered by the signature.
+	Delegation *cid.Cid `json:",omitempty"`
 }
 
 func (a *Attester) AttestResponse(r *Response) (*Attestation, []byte) {
 	rCid, rBody := r.Serialize()
-	s, _ := a.Identity.Sign(append(r.Query.Bytes(), rCid.Bytes()...))
-	fmt.Printf("attesting %s -> %s\n", r.Query, rCid)
-
-	return &Attestation{
+	at := &Attestation{
 		Req:  r.Query,
 		Resp: rCid,
-		Sig:  s,
-	}, rBody
+	}
+	if len(a.Delegation) > 0 {
+		d := a.Delegation[0].CID()
+		at.Delegation = &d
+	}
+	at.Sig, _ = a.Identity.Sign(at.signedBytes())
+	fmt.Printf("attesting %s -> %s\n", r.Query, rCid)
+
+	return at, rBody
+}
+
+func (a *Attestation) signedBytes() []byte {
+	b := append(a.Req.Bytes(), a.Resp.Bytes()...)
+	if a.Delegation != nil {
+		b = append(b, a.Delegation.Bytes()...)
+	}
+	return b
+}
+
+// Verify checks the attestation was signed by the exit.
+func (a *Attestation) Verify(exit crypto.PubKey) error {
+	ok, err := exit.Verify(a.signedBytes(), a.Sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("invalid attestation signature")
+	}
+	return nil
 }
 
 func (a *Attestation) Bytes() []byte {
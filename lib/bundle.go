@@ -0,0 +1,184 @@
+package gemipfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	mc "github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// A bundle carries a page's responses, along with the subresources an exit
+// fetched ahead of the browser asking for them, as a single car. Its root is
+// a dag-json index linking each encrypted response with its attestation.
+// The index only links to response blocks, so a gateway can return the whole
+// bundle by following its links.
+type Bundle struct {
+	Entries []BundleEntry
+}
+
+type BundleEntry struct {
+	Attestation *Attestation
+	// Body is the encrypted response. It is only set when building a bundle.
+	Body []byte
+}
+
+// Car serializes the bundle, returning its root.
+func (b *Bundle) Car() (cid.Cid, []byte, error) {
+	idx, err := qp.BuildMap(basicnode.Prototype.Map, 1, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "entries", qp.List(int64(len(b.Entries)), func(la datamodel.ListAssembler) {
+			for _, e := range b.Entries {
+				qp.ListEntry(la, qp.Map(2, func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "attestation", qp.Bytes(e.Attestation.Bytes()))
+					qp.MapEntry(ma, "response", qp.Link(cidlink.Link{Cid: e.Attestation.Resp}))
+				}))
+			}
+		}))
+	})
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	ib, err := ipld.Encode(idx, dagjson.Encode)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	mh, err := multihash.Sum(ib, multihash.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	root := cid.NewCidV1(uint64(mc.DagJson), mh)
+
+	buf := bytes.NewBuffer(nil)
+	cw, err := storage.NewWritable(buf, []cid.Cid{root}, car.WriteAsCarV1(true))
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	ctx := context.Background()
+	if err := cw.Put(ctx, root.KeyString(), ib); err != nil {
+		return cid.Undef, nil, err
+	}
+	seen := make(map[cid.Cid]struct{})
+	for _, e := range b.Entries {
+		if _, ok := seen[e.Attestation.Resp]; ok {
+			continue
+		}
+		seen[e.Attestation.Resp] = struct{}{}
+		if err := cw.Put(ctx, e.Attestation.Resp.KeyString(), e.Body); err != nil {
+			return cid.Undef, nil, err
+		}
+	}
+	if err := cw.Finalize(); err != nil {
+		return cid.Undef, nil, err
+	}
+	return root, buf.Bytes(), nil
+}
+
+// ParseBundle reads a bundle's index block.
+func ParseBundle(b []byte) (*Bundle, error) {
+	idx, err := ipld.Decode(b, dagjson.Decode)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := idx.LookupByString("entries")
+	if err != nil {
+		return nil, err
+	}
+	bundle := Bundle{}
+	it := entries.ListIterator()
+	if it == nil {
+		return nil, errors.New("bundle entries are not a list")
+	}
+	for !it.Done() {
+		_, e, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		ab, err := lookupBytes(e, "attestation")
+		if err != nil {
+			return nil, err
+		}
+		a, err := ParseAttestation(ab)
+		if err != nil {
+			return nil, err
+		}
+		rn, err := e.LookupByString("response")
+		if err != nil {
+			return nil, err
+		}
+		rl, err := rn.AsLink()
+		if err != nil {
+			return nil, err
+		}
+		resp, ok := rl.(cidlink.Link)
+		if !ok || !a.Resp.Equals(resp.Cid) {
+			return nil, fmt.Errorf("bundle entry for %s links to %s", a.Resp, rl)
+		}
+		bundle.Entries = append(bundle.Entries, BundleEntry{Attestation: a})
+	}
+	return &bundle, nil
+}
+
+func lookupBytes(n datamodel.Node, key string) ([]byte, error) {
+	v, err := n.LookupByString(key)
+	if err != nil {
+		return nil, err
+	}
+	return v.AsBytes()
+}
+
+// DagJSONLinks lists the links in a dag-json block.
+func DagJSONLinks(b []byte) ([]cid.Cid, error) {
+	n, err := ipld.Decode(b, dagjson.Decode)
+	if err != nil {
+		return nil, err
+	}
+	var links []cid.Cid
+	var walk func(n datamodel.Node) error
+	walk = func(n datamodel.Node) error {
+		switch n.Kind() {
+		case datamodel.Kind_Link:
+			l, err := n.AsLink()
+			if err != nil {
+				return err
+			}
+			if cl, ok := l.(cidlink.Link); ok {
+				links = append(links, cl.Cid)
+			}
+		case datamodel.Kind_Map:
+			it := n.MapIterator()
+			for !it.Done() {
+				_, v, err := it.Next()
+				if err != nil {
+					return err
+				}
+				if err := walk(v); err != nil {
+					return err
+				}
+			}
+		case datamodel.Kind_List:
+			it := n.ListIterator()
+			for !it.Done() {
+				_, v, err := it.Next()
+				if err != nil {
+					return err
+				}
+				if err := walk(v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return links, walk(n)
+}
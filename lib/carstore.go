@@ -102,7 +102,9 @@ func (c *CarStore) Add(archive io.ReadSeeker) error {
 	if err != nil {
 		return err
 	}
-	archive.Seek(0, io.SeekStart)
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
 
 	hdr, err := car.NewBlockReader(archive)
 	if err != nil {
@@ -113,6 +115,12 @@ func (c *CarStore) Add(archive io.ReadSeeker) error {
 	}
 	root := hdr.Roots[0]
 
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.root, 0755); err != nil {
+		return err
+	}
 	fileName := path.Join(c.root, fmt.Sprintf("%s.car", root))
 
 	entry := carEntry{
@@ -123,13 +131,13 @@ func (c *CarStore) Add(archive io.ReadSeeker) error {
 	entry.mtx.Lock()
 	defer entry.mtx.Unlock()
 	c.entries.Add(fileName, &entry)
-	fp, err := os.OpenFile(fileName, os.O_CREATE, 0666)
+	fp, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
 	defer fp.Close()
-	io.Copy(fp, archive)
-	return nil
+	_, err = io.Copy(fp, archive)
+	return err
 }
 
 func (c *CarStore) Get(itm cid.Cid) ([]byte, error) {
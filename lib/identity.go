@@ -0,0 +1,297 @@
+package gemipfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// IdentityPassphraseEnv, when set, is the passphrase identities are age
+// encrypted with at rest.
+const IdentityPassphraseEnv = "GEMIPFS_IDENTITY_PASSPHRASE"
+
+// HandoffProtocol serves the handoffs leading to a peer's current identity,
+// one JSON record per line.
+const HandoffProtocol = "/gemipfs/handoff/0.0.1"
+
+// LoadIdentity reads a libp2p private key, decrypting it if needed.
+func LoadIdentity(path string) (crypto.PrivKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, []byte(armor.Header)) {
+		pass, ok := os.LookupEnv(IdentityPassphraseEnv)
+		if !ok {
+			return nil, fmt.Errorf("%s is encrypted; set %s", path, IdentityPassphraseEnv)
+		}
+		id, err := age.NewScryptIdentity(pass)
+		if err != nil {
+			return nil, err
+		}
+		r, err := age.Decrypt(armor.NewReader(bytes.NewReader(b)), id)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt %s: %w", path, err)
+		}
+		if b, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	return crypto.UnmarshalPrivateKey(b)
+}
+
+// SaveIdentity writes a libp2p private key, encrypted if a passphrase is
+// set.
+func SaveIdentity(path string, sk crypto.PrivKey) error {
+	b, err := crypto.MarshalPrivateKey(sk)
+	if err != nil {
+		return err
+	}
+	if pass, ok := os.LookupEnv(IdentityPassphraseEnv); ok {
+		r, err := age.NewScryptRecipient(pass)
+		if err != nil {
+			return err
+		}
+		buf := bytes.NewBuffer(nil)
+		aw := armor.NewWriter(buf)
+		w, err := age.Encrypt(aw, r)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if err := aw.Close(); err != nil {
+			return err
+		}
+		b = buf.Bytes()
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadOrCreateIdentity loads the identity at path, generating an ed25519
+// identity there on first use.
+func LoadOrCreateIdentity(path string) (crypto.PrivKey, error) {
+	sk, err := LoadIdentity(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return sk, err
+	}
+	sk, _, err = crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return sk, SaveIdentity(path, sk)
+}
+
+// Handoff records a peer moving from one identity to another. It is signed
+// by both keys, so neither can claim the other alone.
+type Handoff struct {
+	From    peer.ID
+	To      peer.ID
+	Time    time.Time
+	FromSig []byte
+	ToSig   []byte
+}
+
+func (h *Handoff) signedBytes() []byte {
+	return []byte(fmt.Sprintf("gemipfs handoff\n%s\n%s\n%d", h.From, h.To, h.Time.Unix()))
+}
+
+func NewHandoff(from, to crypto.PrivKey) (*Handoff, error) {
+	fromID, err := peer.IDFromPrivateKey(from)
+	if err != nil {
+		return nil, err
+	}
+	toID, err := peer.IDFromPrivateKey(to)
+	if err != nil {
+		return nil, err
+	}
+	h := Handoff{From: fromID, To: toID, Time: time.Now().Truncate(time.Second)}
+	if h.FromSig, err = from.Sign(h.signedBytes()); err != nil {
+		return nil, err
+	}
+	if h.ToSig, err = to.Sign(h.signedBytes()); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (h *Handoff) Verify() error {
+	for _, s := range []struct {
+		id  peer.ID
+		sig []byte
+	}{{h.From, h.FromSig}, {h.To, h.ToSig}} {
+		pk, err := s.id.ExtractPublicKey()
+		if err != nil {
+			return err
+		}
+		if ok, err := pk.Verify(h.signedBytes(), s.sig); err != nil || !ok {
+			return fmt.Errorf("handoff from %s to %s is not signed by %s", h.From, h.To, s.id)
+		}
+	}
+	return nil
+}
+
+// FollowHandoffs checks that the handoffs lead from one identity to
+// another.
+func FollowHandoffs(handoffs []*Handoff, from, to peer.ID) error {
+	at := from
+	for at != to {
+		next := false
+		for _, h := range handoffs {
+			if h.From == at && h.Verify() == nil {
+				at = h.To
+				next = true
+				break
+			}
+		}
+		if !next {
+			return fmt.Errorf("no handoff from %s towards %s", at, to)
+		}
+	}
+	return nil
+}
+
+func handoffsPath(path string) string {
+	return path + ".handoffs"
+}
+
+// PreviousIdentityPath is where the key replaced by the last rotation is
+// kept, so queries encrypted to it can still be answered.
+func PreviousIdentityPath(path string) string {
+	return path + ".prev"
+}
+
+// RotateIdentity replaces the identity at path with a new one, recording
+// the handoff from the old one.
+func RotateIdentity(path string) (*Handoff, error) {
+	old, err := LoadIdentity(path)
+	if err != nil {
+		return nil, err
+	}
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	h, err := NewHandoff(old, sk)
+	if err != nil {
+		return nil, err
+	}
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	// the keys are saved before the handoff is recorded, so a handoff is
+	// never served to a key that was lost.
+	if err := SaveIdentity(PreviousIdentityPath(path), old); err != nil {
+		return nil, err
+	}
+	if err := SaveIdentity(path, sk); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(handoffsPath(path), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(append(hb, '\n')); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return h, f.Close()
+}
+
+// LoadHandoffs reads the handoffs recorded for the identity at path.
+func LoadHandoffs(path string) ([]*Handoff, error) {
+	b, err := os.ReadFile(handoffsPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseHandoffs(bytes.NewReader(b))
+}
+
+func ParseHandoffs(r io.Reader) ([]*Handoff, error) {
+	var handoffs []*Handoff
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		h := Handoff{}
+		if err := json.Unmarshal(s.Bytes(), &h); err != nil {
+			return nil, err
+		}
+		handoffs = append(handoffs, &h)
+	}
+	return handoffs, s.Err()
+}
+
+func MarshalHandoffs(handoffs []*Handoff) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	for _, h := range handoffs {
+		if err := enc.Encode(h); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// ServeHandoffs answers requests for the handoffs leading to the host's
+// identity.
+func ServeHandoffs(h host.Host, handoffs []*Handoff) error {
+	b, err := MarshalHandoffs(handoffs)
+	if err != nil {
+		return err
+	}
+	h.SetStreamHandler(HandoffProtocol, func(s network.Stream) {
+		defer s.Close()
+		if _, err := s.Write(b); err != nil {
+			log.Printf("could not send handoffs to %s: %v", s.Conn().RemotePeer(), err)
+			s.Reset()
+		}
+	})
+	return nil
+}
+
+// FetchHandoffs asks a peer for the handoffs leading to its identity.
+func FetchHandoffs(ctx context.Context, h host.Host, p peer.ID) ([]*Handoff, error) {
+	s, err := h.NewStream(ctx, p, HandoffProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	stop := context.AfterFunc(ctx, func() { s.Reset() })
+	defer stop()
+	return ParseHandoffs(io.LimitReader(s, 1<<20))
+}
@@ -0,0 +1,70 @@
+package gemipfs
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// A Location is somewhere a response can be stored: either the URL of an
+// HTTP repo, or the multiaddr of a libp2p repo ending in /p2p/<peer id>.
+type Location string
+
+func ParseLocation(s string) (Location, error) {
+	l := Location(s)
+	if l.IsLibP2P() {
+		if _, err := l.AddrInfo(); err != nil {
+			return "", err
+		}
+		return l, nil
+	}
+	if _, err := l.URL(); err != nil {
+		return "", err
+	}
+	return l, nil
+}
+
+func (l Location) IsLibP2P() bool {
+	return strings.HasPrefix(string(l), "/")
+}
+
+func (l Location) AddrInfo() (*peer.AddrInfo, error) {
+	ma, err := multiaddr.NewMultiaddr(string(l))
+	if err != nil {
+		return nil, err
+	}
+	return peer.AddrInfoFromP2pAddr(ma)
+}
+
+func (l Location) URL() (*url.URL, error) {
+	u, err := url.Parse(string(l))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported repo location: %s", l)
+	}
+	return u, nil
+}
+
+// Origin names the repo for binding tokens to it: the peer ID of a libp2p
+// repo, or the host of an HTTP one.
+func (l Location) Origin() string {
+	if l.IsLibP2P() {
+		if ai, err := l.AddrInfo(); err == nil {
+			return ai.ID.String()
+		}
+		return ""
+	}
+	if u, err := l.URL(); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+func (l Location) String() string {
+	return string(l)
+}
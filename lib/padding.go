@@ -0,0 +1,89 @@
+package gemipfs
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+)
+
+// A PaddingPolicy maps the length of a plaintext to the length it should be
+// padded to before encryption, so that ciphertext sizes fall into buckets
+// rather than revealing the exact size of a request or response.
+type PaddingPolicy func(int) int
+
+// NoPadding leaves plaintexts at their natural size.
+func NoPadding(l int) int {
+	return l
+}
+
+// PadmePadding rounds lengths up following the Padmé scheme, which leaks
+// at most O(log log L) bits of the length with at most 12% overhead.
+func PadmePadding(l int) int {
+	if l < 2 {
+		return l
+	}
+	e := bits.Len(uint(l)) - 1
+	s := bits.Len(uint(e))
+	lastBits := e - s
+	mask := (1 << lastBits) - 1
+	return (l + mask) &^ mask
+}
+
+// BucketPadding rounds lengths up to the next multiple of size.
+func BucketPadding(size int) PaddingPolicy {
+	return func(l int) int {
+		if size <= 0 {
+			return l
+		}
+		return ((l + size - 1) / size) * size
+	}
+}
+
+// ParsePaddingPolicy understands "none", "padme", or a bucket size in bytes.
+func ParsePaddingPolicy(s string) (PaddingPolicy, error) {
+	switch s {
+	case "", "none":
+		return NoPadding, nil
+	case "padme":
+		return PadmePadding, nil
+	}
+	size, err := strconv.Atoi(s)
+	if err != nil || size <= 0 {
+		return nil, fmt.Errorf("unknown padding policy: %s", s)
+	}
+	return BucketPadding(size), nil
+}
+
+var errBadPadding = errors.New("invalid padding")
+
+// pad appends an 0x80 marker followed by zeros (ISO/IEC 7816-4) up to the
+// length chosen by the policy. The marker is always present so that unpad
+// can find the end of the plaintext.
+func pad(b []byte, p PaddingPolicy) []byte {
+	if p == nil {
+		p = NoPadding
+	}
+	target := p(len(b) + 1)
+	if target < len(b)+1 {
+		target = len(b) + 1
+	}
+	out := make([]byte, target)
+	copy(out, b)
+	out[len(b)] = 0x80
+	return out
+}
+
+func unpad(b []byte) ([]byte, error) {
+	for i := len(b) - 1; i >= 0; i-- {
+		switch b[i] {
+		case 0:
+			continue
+		case 0x80:
+			return b[:i], nil
+		default:
+			return nil, errBadPadding
+		}
+	}
+	return nil, errBadPadding
+}
@@ -0,0 +1,610 @@
+package gemipfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/circl/blindsign/blindrsa"
+	"golang.org/x/time/rate"
+)
+
+// Access to repos and exits can be gated with publicly verifiable Privacy
+// Pass tokens (RFC 9578, token type 0x0002), issued by a repo's admin
+// endpoint and redeemed once each. Each token is bound to the one exit or
+// repo it is for.
+const (
+	PrivateTokenType uint16 = 0x0002
+
+	TokenDirectoryPath     = "/.well-known/private-token-issuer-directory"
+	TokenRequestPath       = "/token-request"
+	TokenRequestMediaType  = "application/private-token-request"
+	TokenResponseMediaType = "application/private-token-response"
+
+	tokenNk       = 256
+	tokenNonceLen = 32
+	tokenLen      = 2 + tokenNonceLen + sha256.Size + sha256.Size + tokenNk
+	tokenBatch    = 8
+	tokenIssuer   = "gemipfs"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid privacy pass token")
+	ErrTokenSpent   = errors.New("privacy pass token already redeemed")
+	ErrNotAttested  = errors.New("token request is not attested")
+)
+
+// TokenChallenge is the challenge a token is bound to.
+type TokenChallenge struct {
+	IssuerName string
+	OriginInfo string
+}
+
+// TokenChallengeFor is the challenge for tokens redeemable only at origin:
+// an exit's peer ID, or a repo's Location.Origin.
+func TokenChallengeFor(origin string) TokenChallenge {
+	return TokenChallenge{IssuerName: tokenIssuer, OriginInfo: origin}
+}
+
+func (tc TokenChallenge) Marshal() []byte {
+	buf := binary.BigEndian.AppendUint16(nil, PrivateTokenType)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(tc.IssuerName)))
+	buf = append(buf, tc.IssuerName...)
+	// empty redemption context
+	buf = append(buf, 0)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(tc.OriginInfo)))
+	buf = append(buf, tc.OriginInfo...)
+	return buf
+}
+
+func (tc TokenChallenge) digest() [32]byte {
+	return sha256.Sum256(tc.Marshal())
+}
+
+// WWWAuthenticate is the header value used to ask for a token.
+func (tc TokenChallenge) WWWAuthenticate(tokenKey []byte) string {
+	return fmt.Sprintf(`PrivateToken challenge="%s", token-key="%s"`,
+		base64.URLEncoding.EncodeToString(tc.Marshal()),
+		base64.URLEncoding.EncodeToString(tokenKey))
+}
+
+// TokenAttester decides whether a token request is from a client entitled
+// to tokens, such as by a credential and how many it has already had.
+type TokenAttester interface {
+	Attest(req *http.Request) error
+}
+
+// TokenIssuer blindly signs token requests.
+type TokenIssuer struct {
+	signer   blindrsa.Signer
+	tokenKey []byte
+	keyID    [32]byte
+	// Attester, when set, vets token requests. Without one, tokens are not
+	// handed out over HTTP.
+	Attester TokenAttester
+}
+
+func NewTokenIssuer(sk *rsa.PrivateKey) (*TokenIssuer, error) {
+	if sk.N.BitLen() != tokenNk*8 {
+		return nil, fmt.Errorf("token keys must be %d bits", tokenNk*8)
+	}
+	tk, err := marshalTokenKey(&sk.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenIssuer{
+		signer:   blindrsa.NewSigner(sk),
+		tokenKey: tk,
+		keyID:    sha256.Sum256(tk),
+	}, nil
+}
+
+// TokenKey is the issuer public key in its RSASSA-PSS SubjectPublicKeyInfo
+// encoding.
+func (ti *TokenIssuer) TokenKey() []byte {
+	return ti.tokenKey
+}
+
+// Issue answers a TokenRequest with a TokenResponse.
+func (ti *TokenIssuer) Issue(req []byte) ([]byte, error) {
+	if len(req) != 3+tokenNk {
+		return nil, ErrInvalidToken
+	}
+	if binary.BigEndian.Uint16(req) != PrivateTokenType || req[2] != ti.keyID[31] {
+		return nil, ErrInvalidToken
+	}
+	return ti.signer.BlindSign(req[3:])
+}
+
+// ServeDirectory answers requests for the issuer directory.
+func (ti *TokenIssuer) ServeDirectory(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/private-token-issuer-directory")
+	json.NewEncoder(w).Encode(tokenDirectory{
+		IssuerRequestURI: TokenRequestPath,
+		TokenKeys: []tokenDirectoryKey{{
+			TokenType: PrivateTokenType,
+			TokenKey:  base64.URLEncoding.EncodeToString(ti.tokenKey),
+		}},
+	})
+}
+
+// ServeTokenRequest answers token requests the attester vouches for.
+func (ti *TokenIssuer) ServeTokenRequest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != TokenRequestMediaType {
+		http.Error(w, "expected a token request", http.StatusBadRequest)
+		return
+	}
+	if ti.Attester == nil {
+		http.Error(w, ErrNotAttested.Error(), http.StatusForbidden)
+		return
+	}
+	if err := ti.Attester.Attest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	tr, err := io.ReadAll(io.LimitReader(req.Body, 3+tokenNk+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := ti.Issue(tr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", TokenResponseMediaType)
+	w.Write(resp)
+}
+
+// CredentialAttester vouches for token requests carrying one of a set of
+// bearer credentials, each of which can only get so many tokens an hour.
+type CredentialAttester struct {
+	limiters map[string]*rate.Limiter
+}
+
+// LoadCredentialAttester reads credentials, one per line, from path.
+func LoadCredentialAttester(path string, perHour float64) (*CredentialAttester, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ca := &CredentialAttester{limiters: make(map[string]*rate.Limiter)}
+	for _, c := range strings.Split(string(b), "\n") {
+		if c = strings.TrimSpace(c); c != "" {
+			ca.limiters[c] = rate.NewLimiter(rate.Limit(perHour/3600), max(1, int(perHour)))
+		}
+	}
+	if len(ca.limiters) == 0 {
+		return nil, fmt.Errorf("no credentials in %s", path)
+	}
+	return ca, nil
+}
+
+func (ca *CredentialAttester) Attest(req *http.Request) error {
+	c, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ErrNotAttested
+	}
+	lim, ok := ca.limiters[c]
+	if !ok {
+		return ErrNotAttested
+	}
+	if !lim.Allow() {
+		return errors.New("too many tokens requested")
+	}
+	return nil
+}
+
+// TokenVerifier checks tokens and remembers their nonces so each one can
+// only be redeemed once. Spent nonces are kept in a file, so they stay spent
+// across restarts, until the issuer's key changes and every earlier token
+// becomes invalid anyway.
+type TokenVerifier struct {
+	verifier  blindrsa.Verifier
+	tokenKey  []byte
+	keyID     [32]byte
+	challenge TokenChallenge
+	digests   [][32]byte
+
+	mtx     sync.Mutex
+	spent   map[[tokenNonceLen]byte]struct{}
+	pending map[[tokenNonceLen]byte]struct{}
+	log     *os.File
+}
+
+// NewTokenVerifier accepts tokens for any of the challenges, which are
+// the names the verifier's exit or repo is known by. Spent tokens are
+// recorded at spentPath, or only in memory if it is empty.
+func NewTokenVerifier(tokenKey []byte, spentPath string, challenges ...TokenChallenge) (*TokenVerifier, error) {
+	if len(challenges) == 0 {
+		return nil, errors.New("no token challenges")
+	}
+	pk, err := parseTokenKey(tokenKey)
+	if err != nil {
+		return nil, err
+	}
+	v, err := blindrsa.NewVerifier(blindrsa.SHA384PSSDeterministic, pk)
+	if err != nil {
+		return nil, err
+	}
+	tv := &TokenVerifier{
+		verifier:  v,
+		tokenKey:  tokenKey,
+		keyID:     sha256.Sum256(tokenKey),
+		challenge: challenges[0],
+		spent:     make(map[[tokenNonceLen]byte]struct{}),
+		pending:   make(map[[tokenNonceLen]byte]struct{}),
+	}
+	for _, c := range challenges {
+		tv.digests = append(tv.digests, c.digest())
+	}
+	if spentPath != "" {
+		if err := tv.loadSpent(spentPath); err != nil {
+			return nil, err
+		}
+	}
+	return tv, nil
+}
+
+// loadSpent reads the nonces spent under the current key, and opens the
+// file to add more. The file starts with the key id; a file for another key
+// is started afresh.
+func (tv *TokenVerifier) loadSpent(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if len(b) < len(tv.keyID) || !bytes.Equal(b[:len(tv.keyID)], tv.keyID[:]) {
+		b = nil
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := f.WriteAt(tv.keyID[:], 0); err != nil {
+			f.Close()
+			return err
+		}
+	} else {
+		b = b[len(tv.keyID):]
+	}
+	// a torn final write leaves a partial nonce, which is dropped.
+	for ; len(b) >= tokenNonceLen; b = b[tokenNonceLen:] {
+		tv.spent[[tokenNonceLen]byte(b)] = struct{}{}
+	}
+	if _, err := f.Seek(int64(len(tv.keyID)+len(tv.spent)*tokenNonceLen), io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	tv.log = f
+	return nil
+}
+
+// Redeem checks the token and marks it as spent.
+func (tv *TokenVerifier) Redeem(token []byte) error {
+	done, err := tv.Reserve(token)
+	if err != nil {
+		return err
+	}
+	return done(true)
+}
+
+// Reserve checks the token and holds it while the work it pays for is
+// done. The token is spent by calling done with true, or can be redeemed
+// again if the work failed.
+func (tv *TokenVerifier) Reserve(token []byte) (done func(spent bool) error, err error) {
+	if len(token) != tokenLen || binary.BigEndian.Uint16(token) != PrivateTokenType {
+		return nil, ErrInvalidToken
+	}
+	nonce := [tokenNonceLen]byte(token[2 : 2+tokenNonceLen])
+	digest := token[2+tokenNonceLen : 2+tokenNonceLen+sha256.Size]
+	keyID := token[2+tokenNonceLen+sha256.Size : tokenLen-tokenNk]
+	if !tv.forUs(digest) || subtle.ConstantTimeCompare(keyID, tv.keyID[:]) != 1 {
+		return nil, ErrInvalidToken
+	}
+	if err := tv.verifier.Verify(token[:tokenLen-tokenNk], token[tokenLen-tokenNk:]); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	tv.mtx.Lock()
+	defer tv.mtx.Unlock()
+	if _, ok := tv.spent[nonce]; ok {
+		return nil, ErrTokenSpent
+	}
+	if _, ok := tv.pending[nonce]; ok {
+		return nil, ErrTokenSpent
+	}
+	tv.pending[nonce] = struct{}{}
+	return func(spent bool) error {
+		tv.mtx.Lock()
+		defer tv.mtx.Unlock()
+		delete(tv.pending, nonce)
+		if !spent {
+			return nil
+		}
+		tv.spent[nonce] = struct{}{}
+		if tv.log != nil {
+			if _, err := tv.log.Write(nonce[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+func (tv *TokenVerifier) forUs(digest []byte) bool {
+	for _, d := range tv.digests {
+		if subtle.ConstantTimeCompare(digest, d[:]) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// ReserveHTTP reserves the token in a request's Authorization header, and
+// on failure asks for one in the response.
+func (tv *TokenVerifier) ReserveHTTP(w http.ResponseWriter, req *http.Request) (func(spent bool) error, bool) {
+	token, err := TokenFromAuthorization(req.Header.Get("Authorization"))
+	var done func(bool) error
+	if err == nil {
+		done, err = tv.Reserve(token)
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", tv.challenge.WWWAuthenticate(tv.tokenKey))
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	return done, true
+}
+
+// AuthorizationHeader is the header value that redeems a token.
+func AuthorizationHeader(token []byte) string {
+	return fmt.Sprintf(`PrivateToken token="%s"`, base64.URLEncoding.EncodeToString(token))
+}
+
+func TokenFromAuthorization(h string) ([]byte, error) {
+	params, ok := strings.CutPrefix(h, "PrivateToken ")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	for _, p := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if k == "token" {
+			return base64.URLEncoding.DecodeString(strings.Trim(v, `"`))
+		}
+	}
+	return nil, ErrInvalidToken
+}
+
+// TokenWallet holds tokens fetched from an issuer for each origin they are
+// redeemed at, refilling in batches when it runs out.
+type TokenWallet struct {
+	issuer    *url.URL
+	requestTo *url.URL
+	client    blindrsa.Client
+	keyID     [32]byte
+	// credential, if set, is shown to the issuer's attester.
+	credential string
+
+	mtx    sync.Mutex
+	tokens map[string][][]byte
+}
+
+type tokenDirectory struct {
+	IssuerRequestURI string              `json:"issuer-request-uri"`
+	TokenKeys        []tokenDirectoryKey `json:"token-keys"`
+}
+
+type tokenDirectoryKey struct {
+	TokenType uint16 `json:"token-type"`
+	TokenKey  string `json:"token-key"`
+}
+
+// FetchTokenKey retrieves the issuer's public key from its directory.
+func FetchTokenKey(ctx context.Context, issuer *url.URL) ([]byte, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer.JoinPath(TokenDirectoryPath).String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("issuer directory responded %s", resp.Status)
+	}
+	dir := tokenDirectory{}
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return nil, nil, err
+	}
+	requestTo, err := issuer.Parse(dir.IssuerRequestURI)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, k := range dir.TokenKeys {
+		if k.TokenType == PrivateTokenType {
+			tk, err := base64.URLEncoding.DecodeString(k.TokenKey)
+			return tk, requestTo, err
+		}
+	}
+	return nil, nil, errors.New("issuer has no publicly verifiable token key")
+}
+
+func NewTokenWallet(ctx context.Context, issuer *url.URL, credential string) (*TokenWallet, error) {
+	tk, requestTo, err := FetchTokenKey(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := parseTokenKey(tk)
+	if err != nil {
+		return nil, err
+	}
+	c, err := blindrsa.NewClient(blindrsa.SHA384PSSDeterministic, pk)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenWallet{
+		issuer:     issuer,
+		requestTo:  requestTo,
+		client:     c,
+		keyID:      sha256.Sum256(tk),
+		credential: credential,
+		tokens:     make(map[string][][]byte),
+	}, nil
+}
+
+// Token takes a token for origin from the wallet. The lock isn't held while
+// fetching more, so queries to other origins aren't held up.
+func (tw *TokenWallet) Token(ctx context.Context, origin string) ([]byte, error) {
+	if t := tw.take(origin); t != nil {
+		return t, nil
+	}
+	digest := TokenChallengeFor(origin).digest()
+	batch := make([][]byte, 0, tokenBatch)
+	for i := 0; i < tokenBatch; i++ {
+		t, err := tw.fetch(ctx, digest)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, t)
+	}
+	tw.mtx.Lock()
+	defer tw.mtx.Unlock()
+	tw.tokens[origin] = append(tw.tokens[origin], batch[1:]...)
+	return batch[0], nil
+}
+
+func (tw *TokenWallet) take(origin string) []byte {
+	tw.mtx.Lock()
+	defer tw.mtx.Unlock()
+	ts := tw.tokens[origin]
+	if len(ts) == 0 {
+		return nil
+	}
+	tw.tokens[origin] = ts[1:]
+	return ts[0]
+}
+
+func (tw *TokenWallet) fetch(ctx context.Context, digest [32]byte) ([]byte, error) {
+	input := binary.BigEndian.AppendUint16(nil, PrivateTokenType)
+	nonce := make([]byte, tokenNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	input = append(input, nonce...)
+	input = append(input, digest[:]...)
+	input = append(input, tw.keyID[:]...)
+
+	blinded, state, err := tw.client.Blind(rand.Reader, input)
+	if err != nil {
+		return nil, err
+	}
+	tr := binary.BigEndian.AppendUint16(nil, PrivateTokenType)
+	tr = append(tr, tw.keyID[31])
+	tr = append(tr, blinded...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tw.requestTo.String(), bytes.NewReader(tr))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", TokenRequestMediaType)
+	req.Header.Set("Accept", TokenResponseMediaType)
+	if tw.credential != "" {
+		req.Header.Set("Authorization", "Bearer "+tw.credential)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("issuer responded %s", resp.Status)
+	}
+	blindSig, err := io.ReadAll(io.LimitReader(resp.Body, tokenNk))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := tw.client.Finalize(state, blindSig)
+	if err != nil {
+		return nil, err
+	}
+	return append(input, sig...), nil
+}
+
+// RSASSA-PSS SubjectPublicKeyInfo encoding of token keys, per RFC 9578
+// section 6.5.
+var (
+	oidRSASSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidMGF1      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidSHA384    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+)
+
+type pssParameters struct {
+	Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF        mgfAlgorithm             `asn1:"explicit,tag:1"`
+	SaltLength int                      `asn1:"explicit,tag:2"`
+}
+
+type mgfAlgorithm struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters pkix.AlgorithmIdentifier
+}
+
+type pssAlgorithm struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters pssParameters
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pssAlgorithm
+	PublicKey asn1.BitString
+}
+
+func marshalTokenKey(pk *rsa.PublicKey) ([]byte, error) {
+	sha384 := pkix.AlgorithmIdentifier{Algorithm: oidSHA384}
+	pkcs1 := x509.MarshalPKCS1PublicKey(pk)
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pssAlgorithm{
+			Algorithm: oidRSASSAPSS,
+			Parameters: pssParameters{
+				Hash:       sha384,
+				MGF:        mgfAlgorithm{oidMGF1, sha384},
+				SaltLength: 48,
+			},
+		},
+		PublicKey: asn1.BitString{Bytes: pkcs1, BitLength: len(pkcs1) * 8},
+	})
+}
+
+func parseTokenKey(tk []byte) (*rsa.PublicKey, error) {
+	spki := subjectPublicKeyInfo{}
+	if rest, err := asn1.Unmarshal(tk, &spki); err != nil || len(rest) > 0 {
+		return nil, errors.New("invalid token key")
+	}
+	if !spki.Algorithm.Algorithm.Equal(oidRSASSAPSS) {
+		return nil, errors.New("token key is not an RSASSA-PSS key")
+	}
+	return x509.ParsePKCS1PublicKey(spki.PublicKey.Bytes)
+}
@@ -2,8 +2,9 @@ package gemipfs
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
-	"net/url"
 
 	"filippo.io/age"
 	"github.com/ipfs/go-cid"
@@ -22,8 +23,20 @@ type Query struct {
 
 type DecodedQuery struct {
 	Resource cid.Cid
-	Repo     *url.URL
-	Request  SerializedRequest
+	// Repos are where the exit should store the response, in order of
+	// preference. When empty the exit sends the response back directly on
+	// the query stream.
+	Repos   []Location
+	Request SerializedRequest
+	// ReplyKey, if set, is an ephemeral client key the exit encrypts its
+	// reply to.
+	ReplyKey crypto.PubKey
+	// ExitToken is a privacy pass token paying for the exit's work, and
+	// RepoTokens pay for storing the response in each of the Repos.
+	ExitToken  []byte
+	RepoTokens [][]byte
+	// Padding determines the bucketed size of the encrypted query context.
+	Padding PaddingPolicy
 }
 
 func (q *Query) TryDecrypt(id crypto.PrivKey) (*DecodedQuery, error) {
@@ -33,24 +46,102 @@ func (q *Query) TryDecrypt(id crypto.PrivKey) (*DecodedQuery, error) {
 	if err != nil {
 		return nil, err
 	}
-	dcoder := cbor.NewDecoder(out)
+	padded, err := io.ReadAll(out)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := unpad(padded)
+	if err != nil {
+		return nil, err
+	}
+	dcoder := cbor.NewDecoder(bytes.NewReader(plain))
 	sr := SerializedRequest{}
 	if err := dcoder.Decode(&sr); err != nil {
 		return nil, err
 	}
-	rs := ""
+	var rs interface{}
 	if err := dcoder.Decode(&rs); err != nil {
 		return nil, err
 	}
-	rsu, err := url.Parse(rs)
-	if err != nil {
-		return nil, err
-	}
-	return &DecodedQuery{
+	dq := DecodedQuery{
 		Resource: q.Resource,
-		Repo:     rsu,
 		Request:  sr,
-	}, nil
+	}
+	if dq.Repos, err = decodeLocations(rs); err != nil {
+		return nil, err
+	}
+	// the reply key and tokens are absent in queries from older clients.
+	rk := []byte{}
+	if err := dcoder.Decode(&rk); errors.Is(err, io.EOF) {
+		return &dq, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid reply key: %w", err)
+	}
+	if len(rk) > 0 {
+		if dq.ReplyKey, err = crypto.UnmarshalPublicKey(rk); err != nil {
+			return nil, err
+		}
+	}
+	if err := dcoder.Decode(&dq.ExitToken); errors.Is(err, io.EOF) {
+		return &dq, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid exit token: %w", err)
+	}
+	rt := []byte{}
+	if err := dcoder.Decode(&rt); err != nil {
+		return nil, err
+	}
+	// older clients send one token, for the first repo.
+	more := [][]byte{}
+	if err := dcoder.Decode(&more); errors.Is(err, io.EOF) {
+		more = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid repo tokens: %w", err)
+	}
+	if len(rt) > 0 || len(more) > 0 {
+		dq.RepoTokens = append([][]byte{rt}, more...)
+	}
+	return &dq, nil
+}
+
+// RepoToken is the token paying for storing at the i'th of the Repos.
+func (dq *DecodedQuery) RepoToken(i int) []byte {
+	if i < len(dq.RepoTokens) {
+		return dq.RepoTokens[i]
+	}
+	return nil
+}
+
+// decodeLocations accepts either a list of locations, or the single repo
+// url string sent by older clients.
+func decodeLocations(rs interface{}) ([]Location, error) {
+	var strs []string
+	switch v := rs.(type) {
+	case string:
+		if v != "" {
+			strs = append(strs, v)
+		}
+	case []interface{}:
+		for _, e := range v {
+			str, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid repo location: %v", e)
+			}
+			strs = append(strs, str)
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("invalid repo locations: %v", rs)
+	}
+	locs := make([]Location, 0, len(strs))
+	for _, str := range strs {
+		l, err := ParseLocation(str)
+		if err != nil {
+			return nil, err
+		}
+		locs = append(locs, l)
+	}
+	return locs, nil
 }
 
 func (q *Query) Write(w io.Writer) error {
@@ -79,17 +170,79 @@ func ReadQuery(r io.Reader) (*Query, error) {
 
 }
 
-func (dq *DecodedQuery) EncryptTo(p peer.ID) (*Query, error) {
-	lr := agep2p.NewLibP2PRecipient(p)
-	out := bytes.NewBuffer(nil)
-	stream, err := age.Encrypt(out, lr)
-	if err != nil {
+// EncryptTo encrypts the query so that any one of the given exits can
+// answer it.
+func (dq *DecodedQuery) EncryptTo(ps ...peer.ID) (*Query, error) {
+	lrs := make([]age.Recipient, 0, len(ps))
+	for _, p := range ps {
+		lrs = append(lrs, agep2p.NewLibP2PRecipient(p))
+	}
+	return dq.encrypt(lrs...)
+}
+
+// EncryptToKeys is used for exits whose key types (RSA, ECDSA) cannot be
+// recovered from their peer ID alone.
+func (dq *DecodedQuery) EncryptToKeys(pks ...crypto.PubKey) (*Query, error) {
+	lrs := make([]age.Recipient, 0, len(pks))
+	for _, pk := range pks {
+		lr, err := agep2p.NewLibP2PRecipientFromKey(pk)
+		if err != nil {
+			return nil, err
+		}
+		lrs = append(lrs, lr)
+	}
+	return dq.encrypt(lrs...)
+}
+
+func (dq *DecodedQuery) encrypt(lrs ...age.Recipient) (*Query, error) {
+	if len(lrs) == 0 {
+		return nil, errors.New("no recipients for query")
+	}
+	plain := bytes.NewBuffer(nil)
+	if err := cbor.Encode(plain, dq.Request); err != nil {
 		return nil, err
 	}
-	if err := cbor.Encode(stream, dq.Request); err != nil {
+	rs := make([]string, 0, len(dq.Repos))
+	for _, r := range dq.Repos {
+		rs = append(rs, r.String())
+	}
+	if err := cbor.Encode(plain, rs); err != nil {
+		return nil, err
+	}
+	rk := []byte{}
+	if dq.ReplyKey != nil {
+		var err error
+		if rk, err = crypto.MarshalPublicKey(dq.ReplyKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := cbor.Encode(plain, rk); err != nil {
+		return nil, err
+	}
+	if err := cbor.Encode(plain, dq.ExitToken); err != nil {
+		return nil, err
+	}
+	rt := []byte{}
+	if len(dq.RepoTokens) > 0 {
+		rt = dq.RepoTokens[0]
+	}
+	if err := cbor.Encode(plain, rt); err != nil {
+		return nil, err
+	}
+	more := [][]byte{}
+	if len(dq.RepoTokens) > 1 {
+		more = dq.RepoTokens[1:]
+	}
+	if err := cbor.Encode(plain, more); err != nil {
+		return nil, err
+	}
+
+	out := bytes.NewBuffer(nil)
+	stream, err := age.Encrypt(out, lrs...)
+	if err != nil {
 		return nil, err
 	}
-	if err := cbor.Encode(stream, dq.Repo.String()); err != nil {
+	if _, err := stream.Write(pad(plain.Bytes(), dq.Padding)); err != nil {
 		return nil, err
 	}
 	stream.Close()
@@ -0,0 +1,155 @@
+package gemipfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"filippo.io/age"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	agep2p "github.com/willscott/go-gemipfs/age"
+)
+
+// SessionKey is an ephemeral client identity, made for a single query. Its
+// public half travels in the encrypted query so the exit can reply to the
+// client privately.
+type SessionKey struct {
+	priv crypto.PrivKey
+}
+
+func NewSessionKey() (*SessionKey, error) {
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionKey{sk}, nil
+}
+
+func (sk *SessionKey) Public() crypto.PubKey {
+	return sk.priv.GetPublic()
+}
+
+type ReplyStatus int
+
+const (
+	ReplyOK ReplyStatus = iota
+	// ReplyBadRequest means the exit could not understand the query.
+	ReplyBadRequest
+	// ReplyFetchFailed means the exit could not reach the origin.
+	ReplyFetchFailed
+	// ReplyStoreFailed means the response could not be stored in the repo.
+	ReplyStoreFailed
+	// ReplyUnauthorized means the query did not carry a valid exit token.
+	ReplyUnauthorized
+	// ReplyForbidden means the exit's egress policy does not allow the
+	// request.
+	ReplyForbidden
+	// ReplyBusy means the exit is over a limit, and the query should be
+	// retried after RetryAfter, or sent elsewhere.
+	ReplyBusy
+)
+
+// Reply is what an exit sends back on the query stream to a client that
+// provided a reply key.
+type Reply struct {
+	Status      ReplyStatus
+	Message     string       `json:",omitempty"`
+	Attestation *Attestation `json:",omitempty"`
+	// Response holds the encrypted response when it is delivered directly
+	// rather than through a repo.
+	Response []byte `json:",omitempty"`
+	// Bundle is the root of a page bundle stored alongside the response,
+	// holding the page's prefetched subresources.
+	Bundle *cid.Cid `json:",omitempty"`
+	// RetryAfter is how long a busy exit asks to be left alone.
+	RetryAfter time.Duration `json:",omitempty"`
+}
+
+func (r *Reply) Err() error {
+	if r.Status == ReplyOK {
+		return nil
+	}
+	return &ReplyError{r.Status, r.Message, r.RetryAfter}
+}
+
+type ReplyError struct {
+	Status     ReplyStatus
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (re *ReplyError) Error() string {
+	return "exit error: " + re.Message
+}
+
+// Seal encrypts the reply to the client's reply key.
+func (r *Reply) Seal(to crypto.PubKey, p PaddingPolicy) ([]byte, error) {
+	plain, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	lr, err := agep2p.NewLibP2PRecipientFromKey(to)
+	if err != nil {
+		return nil, err
+	}
+	out := bytes.NewBuffer(nil)
+	stream, err := age.Encrypt(out, lr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(pad(plain, p)); err != nil {
+		return nil, err
+	}
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// OpenReply decrypts a reply sealed to the session key.
+func OpenReply(sk *SessionKey, b []byte) (*Reply, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty reply")
+	}
+	out, err := age.Decrypt(bytes.NewReader(b), agep2p.NewLibP2PIdentity(sk.priv))
+	if err != nil {
+		return nil, err
+	}
+	padded, err := io.ReadAll(out)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := unpad(padded)
+	if err != nil {
+		return nil, err
+	}
+	r := Reply{}
+	if err := json.Unmarshal(plain, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ReadLegacyReply parses the reply of an exit to a query without a reply
+// key: a bare attestation, followed by the encrypted response if it is
+// delivered directly.
+func ReadLegacyReply(b []byte) (*Reply, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty reply")
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	a := Attestation{}
+	if err := dec.Decode(&a); err != nil {
+		return nil, err
+	}
+	r := Reply{Status: ReplyOK, Attestation: &a}
+	// the encoder terminates the attestation with a newline.
+	if rest := bytes.TrimPrefix(b[dec.InputOffset():], []byte("\n")); len(rest) > 0 {
+		r.Response = rest
+	}
+	return &r, nil
+}
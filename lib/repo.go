@@ -0,0 +1,151 @@
+package gemipfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Repos accept and serve blocks over libp2p as well as HTTP. Each request is
+// a single stream: the client writes the block (put) or cid (get) and closes
+// its side, and the repo answers with a status byte followed by the cid
+// (put) or block (get). Puts are prefixed by a varint length delimited
+// privacy pass token, which is empty if the repo does not require one. Car
+// puts carry a car of blocks, and are answered with its root.
+const (
+	RepoPutProtocol    = "/gemipfs/repo/put/0.0.2"
+	RepoPutCarProtocol = "/gemipfs/repo/putcar/0.0.1"
+	RepoGetProtocol    = "/gemipfs/repo/get/0.0.1"
+
+	// CarContentType marks HTTP puts of a car rather than a single block.
+	CarContentType = "application/vnd.ipld.car"
+
+	// MaxBlockSize bounds the size of a stored response.
+	MaxBlockSize = 64 << 20
+)
+
+type RepoStatus byte
+
+const (
+	RepoOK RepoStatus = iota
+	RepoNotFound
+	RepoError
+	RepoUnauthorized
+)
+
+var (
+	ErrNotInRepo        = errors.New("not found in repo")
+	ErrRepoUnauthorized = errors.New("repo requires a valid token")
+)
+
+// ErrBlockTooLarge is returned for blocks over MaxBlockSize.
+var ErrBlockTooLarge = fmt.Errorf("block exceeds %d bytes", MaxBlockSize)
+
+// ReadBlock reads a block of up to MaxBlockSize bytes. Larger blocks are
+// refused rather than cut off, which would store them under the wrong cid.
+func ReadBlock(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, MaxBlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MaxBlockSize {
+		return nil, ErrBlockTooLarge
+	}
+	return b, nil
+}
+
+// CheckBlock checks a block fetched from a repo is the one asked for. Repos
+// aren't trusted, and the key responses are sealed with is no secret, so an
+// unchecked block could be any response.
+func CheckBlock(c cid.Cid, b []byte) error {
+	got, err := c.Prefix().Sum(b)
+	if err != nil {
+		return err
+	}
+	if !got.Equals(c) {
+		return fmt.Errorf("repo returned %s, not %s", got, c)
+	}
+	return nil
+}
+
+// PutToRepo stores a block at a libp2p repo, returning its cid.
+func PutToRepo(ctx context.Context, h host.Host, repo peer.AddrInfo, blk []byte, token []byte) (cid.Cid, error) {
+	return putToRepo(ctx, h, repo, RepoPutProtocol, blk, token)
+}
+
+// PutCarToRepo stores the blocks of a car at a libp2p repo, returning its
+// root.
+func PutCarToRepo(ctx context.Context, h host.Host, repo peer.AddrInfo, car []byte, token []byte) (cid.Cid, error) {
+	return putToRepo(ctx, h, repo, RepoPutCarProtocol, car, token)
+}
+
+func putToRepo(ctx context.Context, h host.Host, repo peer.AddrInfo, proto protocol.ID, body []byte, token []byte) (cid.Cid, error) {
+	req := binary.AppendUvarint(nil, uint64(len(token)))
+	req = append(req, token...)
+	req = append(req, body...)
+	resp, err := repoRoundTrip(ctx, h, repo, proto, req)
+	if err != nil {
+		return cid.Undef, err
+	}
+	_, c, err := cid.CidFromBytes(resp)
+	return c, err
+}
+
+// GetFromRepo retrieves a block from a libp2p repo.
+func GetFromRepo(ctx context.Context, h host.Host, repo peer.AddrInfo, c cid.Cid) ([]byte, error) {
+	b, err := repoRoundTrip(ctx, h, repo, RepoGetProtocol, c.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckBlock(c, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func repoRoundTrip(ctx context.Context, h host.Host, repo peer.AddrInfo, proto protocol.ID, req []byte) ([]byte, error) {
+	if len(repo.Addrs) > 0 {
+		if err := h.Connect(ctx, repo); err != nil {
+			return nil, err
+		}
+	}
+	s, err := h.NewStream(ctx, repo.ID, proto)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	stop := context.AfterFunc(ctx, func() { s.Reset() })
+	defer stop()
+
+	if _, err := s.Write(req); err != nil {
+		return nil, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		return nil, err
+	}
+	status := []byte{0}
+	if _, err := io.ReadFull(s, status); err != nil {
+		return nil, err
+	}
+	resp, err := ReadBlock(s)
+	if err != nil {
+		return nil, err
+	}
+	switch RepoStatus(status[0]) {
+	case RepoOK:
+		return resp, nil
+	case RepoNotFound:
+		return nil, ErrNotInRepo
+	case RepoUnauthorized:
+		return nil, fmt.Errorf("%w: %s", ErrRepoUnauthorized, resp)
+	default:
+		return nil, fmt.Errorf("repo error: %s", resp)
+	}
+}
@@ -4,9 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
-	"os"
+	"net/textproto"
+	"net/url"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,6 +25,59 @@ import (
 	cbor "github.com/whyrusleeping/cbor/go"
 )
 
+// maxRedirects is how many redirects are followed by clients that don't
+// set their own policy, as with net/http.
+const maxRedirects = 10
+
+// hopHeaders are about the connection a request came over, to the proxy,
+// rather than the request itself, so they aren't passed on to the origin.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// credentialHeaders identify the client to the origin, so a response to a
+// request carrying them may be meant only for that client.
+var credentialHeaders = []string{"Authorization", "Cookie"}
+
+// variantHeaders ask for a different response than the request's method and
+// url alone would get, such as part of it or only whether it changed.
+var variantHeaders = []string{
+	"Accept-Encoding",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Range",
+	"If-Unmodified-Since",
+	"Range",
+}
+
+// revalidationHeaders are sent by browsers checking what they have cached
+// is current. Dropping them gets the full response, which can be shared.
+var revalidationHeaders = []string{"If-Modified-Since", "If-None-Match"}
+
+// stripHopHeaders removes hop-by-hop headers, including any the Connection
+// header names.
+func stripHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if f = textproto.TrimString(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
 type Request struct {
 	time.Time
 	uuid.UUID
@@ -50,18 +110,7 @@ func (r *Request) Serialize() (SerializedRequest, error) {
 	if err != nil {
 		return nil, err
 	}
-	rw := bytes.NewReader(dumpRequest)
-	digest := "sha1:" + warc.GetSHA1(rw)
-	reqArc := warc.NewRecord(os.TempDir(), false)
-	reqArc.Header.Set("WARC-Type", "request")
-	reqArc.Header.Set("WARC-Payload-Digest", digest)
-	reqArc.Header.Set("WARC-Block-Digest", digest)
-	reqArc.Header.Set("WARC-Target-URI", r.URL.String())
-	reqArc.Header.Set("WARC-Date", r.Time.UTC().Format(time.RFC3339Nano))
-	reqArc.Header.Set("WARC-Record-ID", "<urn:uuid:"+r.UUID.String()+">")
-	reqArc.Header.Set("Host", r.URL.Host)
-	reqArc.Header.Set("Content-Type", "application/http; msgtype=request")
-	reqArc.Content.Write(dumpRequest)
+	reqArc := newRecord(r, "request", r.URL.String(), r.UUID.String(), "application/http; msgtype=request", dumpRequest)
 
 	buf := bytes.NewBuffer(nil)
 	writer := &warc.Writer{
@@ -82,7 +131,15 @@ func (r *Request) Serialize() (SerializedRequest, error) {
 func (r *Request) Canonicalize() *Request {
 	// TODO: date quantized based on expected etag / etc
 	// TODO: strip un-needed browser UA / other headers that shouldn't change response
-	return r
+	c := *r
+	c.Request = r.Request.Clone(r.Context())
+	stripHopHeaders(c.Header)
+	for _, h := range revalidationHeaders {
+		c.Header.Del(h)
+	}
+	// exits negotiate their own encoding with origins, and respond decoded.
+	c.Header.Del("Accept-Encoding")
+	return &c
 }
 
 func ParseRequest(ctx context.Context, sr SerializedRequest) (*Request, error) {
@@ -100,10 +157,35 @@ func ParseRequest(ctx context.Context, sr SerializedRequest) (*Request, error) {
 	if err != nil {
 		return nil, err
 	}
-	hr, err := http.NewRequestWithContext(ctx, reqTmpl.Method, reqTmpl.URL.String(), reqTmpl.Body)
+	// the body is buffered so it can be sent again if a redirect asks.
+	body, err := io.ReadAll(reqTmpl.Body)
 	if err != nil {
 		return nil, err
 	}
+	var br io.Reader
+	if len(body) > 0 {
+		br = bytes.NewReader(body)
+	}
+	// requests proxied over tls are dumped in origin form, with only a path;
+	// the record says where they were going.
+	u := reqTmpl.URL
+	if !u.IsAbs() {
+		if u, err = url.Parse(rcrd.Header.Get("WARC-Target-URI")); err != nil {
+			return nil, err
+		}
+	}
+	hr, err := http.NewRequestWithContext(ctx, reqTmpl.Method, u.String(), br)
+	if err != nil {
+		return nil, err
+	}
+	// the headers are replayed as they were sent, other than those about
+	// the connection to the proxy. The length is set by the body.
+	hr.Header = reqTmpl.Header.Clone()
+	stripHopHeaders(hr.Header)
+	hr.Header.Del("Content-Length")
+	if reqTmpl.Host != "" {
+		hr.Host = reqTmpl.Host
+	}
 
 	dt := time.Now()
 	date := rcrd.Header.Get("WARC-Date")
@@ -129,13 +211,120 @@ func ParseRequest(ctx context.Context, sr SerializedRequest) (*Request, error) {
 	}, nil
 }
 
+// Do makes the request, recording each request and response the client
+// makes along the way, including redirects, in the response's transcript.
 func (r *Request) Do(q cid.Cid, c *http.Client) (*Response, error) {
-	hr, err := c.Do(r.Request)
+	// requests are dumped before they're sent, while their bodies can still
+	// be read.
+	reqDump, err := httputil.DumpRequest(r.Request, true)
+	if err != nil {
+		return nil, err
+	}
+	var chain []exchange
+	var ip string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				ip = addr.IP.String()
+			}
+		},
+	}
+	rc := *c
+	rc.CheckRedirect = func(next *http.Request, via []*http.Request) error {
+		if c.CheckRedirect != nil {
+			if err := c.CheckRedirect(next, via); err != nil {
+				return err
+			}
+		} else if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		// the redirect's body is closed once it is followed.
+		x, err := newExchange(reqDump, next.Response, ip)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, *x)
+		ip = ""
+		reqDump, err = httputil.DumpRequest(next, true)
+		return err
+	}
+	hr, err := rc.Do(r.Request.WithContext(httptrace.WithClientTrace(r.Request.Context(), trace)))
 	if err != nil {
 		return nil, err
 	}
+	x, err := newExchange(reqDump, hr, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	return responseFrom(q, r, append(chain, *x))
+}
+
+// Public reports whether the response to the request can be shared: the
+// request is safe to repeat, carries no credentials and asks for the whole
+// response, so anyone making it would get the same response. Responses to other requests are private,
+// passed through the exit to the client that made them and never cached or
+// stored in a repo.
+func (r *Request) Public() bool {
+	if r.Method != "" && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	for _, h := range append(credentialHeaders, variantHeaders...) {
+		if r.Header.Get(h) != "" {
+			return false
+		}
+	}
+	return true
+}
 
-	return ResponseFrom(q, r, hr)
+// StripCredentials removes the headers identifying the client to the
+// origin, so the request is made anonymously.
+func (r *Request) StripCredentials() {
+	for _, h := range credentialHeaders {
+		r.Header.Del(h)
+	}
+}
+
+// RequestCID identifies what a request asks for, independent of when or by
+// whom it is made, so that responses fetched ahead of time by an exit can be
+// matched to the browser's later request.
+func (r *Request) RequestCID() cid.Cid {
+	return RequestCID(r.Method, r.URL)
+}
+
+// VariantKey identifies a request by everything that can change its
+// response: its method, url and headers, but not when or by whom it was
+// made. Requests with the same key can share a response.
+func (r *Request) VariantKey() string {
+	h := sha256.New()
+	method := r.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	fmt.Fprintf(h, "%s %s\n", method, r.URL)
+	keys := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s: %q\n", k, r.Header[k])
+	}
+	return string(h.Sum(nil))
+}
+
+func RequestCID(method string, u *url.URL) cid.Cid {
+	if method == "" {
+		method = http.MethodGet
+	}
+	cu := *u
+	cu.Fragment = ""
+	cu.RawFragment = ""
+
+	buf := bytes.NewBuffer(nil)
+	cbor.Encode(buf, []string{method, cu.String()})
+	mh, _ := multihash.Sum(buf.Bytes(), multihash.SHA2_256, -1)
+	return cid.NewCidV1(uint64(mc.Https), mh)
 }
 
 func (r *Request) DomainHash() cid.Cid {
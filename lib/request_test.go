@@ -0,0 +1,208 @@
+package gemipfs
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// captured are requests as browsers send them to a proxy. Those for https
+// urls are as read from inside the tls tunnel, in origin form.
+var captured = []struct {
+	name  string
+	https bool
+	raw   string
+}{
+	{"chrome get", false, "GET http://example.com/index.html?q=1 HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Proxy-Connection: keep-alive\r\n" +
+		"Upgrade-Insecure-Requests: 1\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36\r\n" +
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7\r\n" +
+		"Accept-Encoding: gzip, deflate\r\n" +
+		"Accept-Language: en-US,en;q=0.9\r\n" +
+		"\r\n"},
+	{"chrome post", true, "POST /api/submit HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Connection: keep-alive\r\n" +
+		"Content-Length: 13\r\n" +
+		"sec-ch-ua: \"Not_A Brand\";v=\"8\", \"Chromium\";v=\"120\"\r\n" +
+		"sec-ch-ua-platform: \"Linux\"\r\n" +
+		"sec-ch-ua-mobile: ?0\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36\r\n" +
+		"Content-Type: application/x-www-form-urlencoded\r\n" +
+		"Accept: */*\r\n" +
+		"Origin: https://example.com\r\n" +
+		"Sec-Fetch-Site: same-origin\r\n" +
+		"Sec-Fetch-Mode: cors\r\n" +
+		"Sec-Fetch-Dest: empty\r\n" +
+		"Referer: https://example.com/form\r\n" +
+		"Accept-Encoding: gzip, deflate, br\r\n" +
+		"Accept-Language: en-US,en;q=0.9\r\n" +
+		"\r\n" +
+		"name=gemipfs&"},
+	{"chrome range", true, "GET /video.mp4 HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Connection: keep-alive\r\n" +
+		"Accept-Encoding: identity;q=1, *;q=0\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36\r\n" +
+		"Accept: */*\r\n" +
+		"Sec-Fetch-Site: same-origin\r\n" +
+		"Sec-Fetch-Mode: no-cors\r\n" +
+		"Sec-Fetch-Dest: video\r\n" +
+		"Referer: https://example.com/watch\r\n" +
+		"Accept-Language: en-US,en;q=0.9\r\n" +
+		"Range: bytes=0-\r\n" +
+		"\r\n"},
+	{"firefox get", true, "GET / HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0\r\n" +
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8\r\n" +
+		"Accept-Language: en-US,en;q=0.5\r\n" +
+		"Accept-Encoding: gzip, deflate, br\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Upgrade: h2c\r\n" +
+		"Upgrade-Insecure-Requests: 1\r\n" +
+		"Sec-Fetch-Dest: document\r\n" +
+		"Sec-Fetch-Mode: navigate\r\n" +
+		"Sec-Fetch-Site: none\r\n" +
+		"Sec-Fetch-User: ?1\r\n" +
+		"TE: trailers\r\n" +
+		"\r\n"},
+	{"firefox post", false, "POST http://example.com/login HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0\r\n" +
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8\r\n" +
+		"Accept-Language: en-US,en;q=0.5\r\n" +
+		"Accept-Encoding: gzip, deflate\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-Length: 17\r\n" +
+		"Origin: http://example.com\r\n" +
+		"Proxy-Connection: keep-alive\r\n" +
+		"Proxy-Authorization: Basic dXNlcjpwYXNz\r\n" +
+		"Connection: keep-alive\r\n" +
+		"Referer: http://example.com/\r\n" +
+		"\r\n" +
+		"{\"user\":\"alice\"}\n"},
+	{"firefox range", true, "GET /archive.tar HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0\r\n" +
+		"Accept: */*\r\n" +
+		"Accept-Language: en-US,en;q=0.5\r\n" +
+		"Range: bytes=1024-2047\r\n" +
+		"If-Range: \"5e8a-60d2c\"\r\n" +
+		"Connection: keep-alive\r\n" +
+		"Keep-Alive: timeout=5\r\n" +
+		"Sec-Fetch-Dest: empty\r\n" +
+		"Sec-Fetch-Mode: no-cors\r\n" +
+		"Sec-Fetch-Site: same-origin\r\n" +
+		"\r\n"},
+}
+
+// readCaptured reads a captured request as the proxy gets it, with the url
+// of those over tls filled in from the tunnel.
+func readCaptured(t *testing.T, raw string, https bool) *http.Request {
+	t.Helper()
+	hr, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if https {
+		hr.URL.Scheme = "https"
+		hr.URL.Host = hr.Host
+	}
+	return hr
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, c := range captured {
+		t.Run(c.name, func(t *testing.T) {
+			sent := readCaptured(t, c.raw, c.https)
+			// what the origin should see: everything but the hop-by-hop
+			// headers, with the length set from the body.
+			want := sent.Header.Clone()
+			for _, h := range append(hopHeaders, "Content-Length") {
+				want.Del(h)
+			}
+			if len(want) == 0 {
+				t.Fatal("no headers to pass on")
+			}
+			wantBody, err := io.ReadAll(readCaptured(t, c.raw, c.https).Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := Wrap(sent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sr, err := r.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ParseRequest(context.Background(), sr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Method != sent.Method {
+				t.Errorf("method %s, want %s", got.Method, sent.Method)
+			}
+			if got.URL.String() != sent.URL.String() {
+				t.Errorf("url %s, want %s", got.URL, sent.URL)
+			}
+			if got.Host != sent.Host {
+				t.Errorf("host %s, want %s", got.Host, sent.Host)
+			}
+			if got.UUID != r.UUID {
+				t.Errorf("uuid %s, want %s", got.UUID, r.UUID)
+			}
+			if !reflect.DeepEqual(got.Header, want) {
+				t.Errorf("headers\n%v\nwant\n%v", got.Header, want)
+			}
+			for _, h := range append(hopHeaders, "Content-Length") {
+				if v := got.Header.Get(h); v != "" {
+					t.Errorf("%s: %s was passed on", h, v)
+				}
+			}
+
+			var gotBody []byte
+			if got.Body != nil {
+				if gotBody, err = io.ReadAll(got.Body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(gotBody) != string(wantBody) {
+				t.Errorf("body %q, want %q", gotBody, wantBody)
+			}
+			if got.ContentLength != int64(len(wantBody)) {
+				t.Errorf("content length %d, want %d", got.ContentLength, len(wantBody))
+			}
+		})
+	}
+}
+
+func TestCanonicalizeDropsVariants(t *testing.T) {
+	for _, c := range captured {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := Wrap(readCaptured(t, c.raw, c.https))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cr := r.Canonicalize()
+			for _, h := range append(append(hopHeaders, revalidationHeaders...), "Accept-Encoding") {
+				if v := cr.Header.Get(h); v != "" {
+					t.Errorf("%s: %s survived canonicalization", h, v)
+				}
+			}
+			// ranges ask for a different response, so they're kept.
+			if v := r.Header.Get("Range"); v != "" && cr.Header.Get("Range") != v {
+				t.Errorf("range %q was changed to %q", v, cr.Header.Get("Range"))
+			}
+		})
+	}
+}
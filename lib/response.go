@@ -4,11 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/http/httputil"
-	"os"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/CorentinB/warc"
@@ -23,6 +25,8 @@ type Response struct {
 	Query      cid.Cid
 	req        *Request
 	Transcript []byte
+	// Padding determines the bucketed size of the encrypted transcript.
+	Padding PaddingPolicy `cbor:"-"`
 }
 
 func (r *Response) Write(w io.Writer) error {
@@ -39,9 +43,57 @@ func (r *Response) Write(w io.Writer) error {
 	return err
 }
 
+// defaultExpiry is how long responses without explicit freshness are
+// reused for, if their status is cacheable by default.
+const defaultExpiry = 5 * time.Minute
+
+// Expiry is how long the response can be reused for a shared cache, from
+// its Cache-Control and Expires headers. It is zero for responses that
+// must not be reused.
 func (r *Response) Expiry() time.Duration {
-	//todo: get from headers
-	return 5 * time.Minute
+	hr, err := r.HTTP(nil)
+	if err != nil {
+		return 0
+	}
+	hr.Body.Close()
+
+	maxAge, sMaxAge := -1, -1
+	for _, d := range strings.Split(strings.Join(hr.Header.Values("Cache-Control"), ","), ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(d), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "max-age":
+			maxAge, _ = strconv.Atoi(strings.Trim(val, `"`))
+		case "s-maxage":
+			sMaxAge, _ = strconv.Atoi(strings.Trim(val, `"`))
+		}
+	}
+	if sMaxAge >= 0 {
+		return time.Duration(sMaxAge) * time.Second
+	}
+	if maxAge >= 0 {
+		return time.Duration(maxAge) * time.Second
+	}
+	if exp := hr.Header.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(hr.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return max(0, t.Sub(date))
+	}
+	switch hr.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusPartialContent,
+		http.StatusMultipleChoices, http.StatusMovedPermanently, http.StatusPermanentRedirect,
+		http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone, http.StatusRequestURITooLong,
+		http.StatusNotImplemented:
+		return defaultExpiry
+	}
+	return 0
 }
 
 func (r *Response) Serialize() (cid.Cid, []byte) {
@@ -49,7 +101,7 @@ func (r *Response) Serialize() (cid.Cid, []byte) {
 	skf := (*[32]byte)(sk)
 	nonce := sha256.New().Sum(append([]byte("nonce"), r.Query.Hash()...))
 	noncef := (*[24]byte)(nonce)
-	enc := box.SealAfterPrecomputation([]byte{}, r.Transcript, noncef, skf)
+	enc := box.SealAfterPrecomputation([]byte{}, pad(r.Transcript, r.Padding), noncef, skf)
 
 	mh, _ := multihash.Sum(enc, multihash.SHA2_256, -1)
 	c := cid.NewCidV1(uint64(mc.Https), mh)
@@ -69,10 +121,14 @@ func ReadResponse(query cid.Cid, r io.Reader) (*Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	transcript, ok := box.OpenAfterPrecomputation([]byte{}, buf, noncef, skf)
+	padded, ok := box.OpenAfterPrecomputation([]byte{}, buf, noncef, skf)
 	if !ok {
 		return nil, fmt.Errorf("failed to decrypt %s usking shared key %+x", query, skf)
 	}
+	transcript, err := unpad(padded)
+	if err != nil {
+		return nil, err
+	}
 
 	rsp := Response{}
 	rsp.Query = query
@@ -81,17 +137,78 @@ func ReadResponse(query cid.Cid, r io.Reader) (*Response, error) {
 }
 
 func (r *Response) HTTP(req *http.Request) (*http.Response, error) {
-	ncr := io.NopCloser(bytes.NewReader(r.Transcript))
-	reader, err := warc.NewReader(ncr)
+	final, err := r.final()
 	if err != nil {
 		return nil, err
 	}
-	rcrd, _, err := reader.ReadRecord()
+	return http.ReadResponse(bufio.NewReader(final.Content), req)
+}
+
+// URL is where the final response came from, after any redirects. Links in
+// it are relative to this rather than the url first asked for.
+func (r *Response) URL() (*url.URL, error) {
+	final, err := r.final()
 	if err != nil {
 		return nil, err
 	}
+	return url.Parse(final.Header.Get("WARC-Target-URI"))
+}
 
-	return http.ReadResponse(bufio.NewReader(rcrd.Content), req)
+// final is the last response record. Redirects followed by the exit come
+// first.
+func (r *Response) final() (*warc.Record, error) {
+	reader, err := warc.NewReader(io.NopCloser(bytes.NewReader(r.Transcript)))
+	if err != nil {
+		return nil, err
+	}
+	var final *warc.Record
+	for {
+		rcrd, eol, err := reader.ReadRecord()
+		if err != nil {
+			return nil, err
+		}
+		if eol {
+			break
+		}
+		if rcrd.Header.Get("WARC-Type") == "response" {
+			final = rcrd
+		}
+	}
+	if final == nil {
+		return nil, errors.New("no response in transcript")
+	}
+	return final, nil
+}
+
+// SetsCookies reports whether any response in the transcript, including
+// redirects followed on the way, sets a cookie. The cookie is for whoever
+// made the request, so the response can't be shared. Transcripts that can't
+// be read are assumed to.
+func (r *Response) SetsCookies() bool {
+	reader, err := warc.NewReader(io.NopCloser(bytes.NewReader(r.Transcript)))
+	if err != nil {
+		return true
+	}
+	for {
+		rcrd, eol, err := reader.ReadRecord()
+		if err != nil {
+			return true
+		}
+		if eol {
+			return false
+		}
+		if rcrd.Header.Get("WARC-Type") != "response" {
+			continue
+		}
+		hr, err := http.ReadResponse(bufio.NewReader(rcrd.Content), nil)
+		if err != nil {
+			return true
+		}
+		hr.Body.Close()
+		if len(hr.Header.Values("Set-Cookie")) > 0 {
+			return true
+		}
+	}
 }
 
 func ResponseFromWARC(q cid.Cid, httpReq *http.Request, respArc []byte) (*Response, error) {
@@ -107,38 +224,21 @@ func ResponseFromWARC(q cid.Cid, httpReq *http.Request, respArc []byte) (*Respon
 }
 
 func ResponseFrom(q cid.Cid, r *Request, hr *http.Response) (*Response, error) {
-	dumpResponse, err := httputil.DumpResponse(hr, true)
+	x, err := newExchange(nil, hr, "")
 	if err != nil {
 		return nil, err
 	}
+	return responseFrom(q, r, []exchange{*x})
+}
 
-	rw := bytes.NewReader(dumpResponse)
-	digest := "sha1:" + warc.GetSHA1(rw)
-	respArc := warc.NewRecord(os.TempDir(), false)
-	respArc.Header.Set("WARC-Type", "response")
-	respArc.Header.Set("WARC-Payload-Digest", digest)
-	respArc.Header.Set("WARC-Block-Digest", digest)
-	respArc.Header.Set("WARC-Target-URI", r.URL.String())
-	respArc.Header.Set("WARC-Date", r.Time.UTC().Format(time.RFC3339Nano))
-	respArc.Header.Set("WARC-Record-ID", "<urn:uuid:"+r.UUID.String()+">")
-	respArc.Header.Set("Host", r.URL.Host)
-	respArc.Header.Set("Content-Type", "application/http; msgtype=response")
-	respArc.Content.Write(dumpResponse)
-
-	buf := bytes.NewBuffer(nil)
-	writer := &warc.Writer{
-		FileName:    "",
-		Compression: "",
-		FileWriter:  bufio.NewWriter(buf),
-	}
-	_, err = writer.WriteRecord(respArc)
+func responseFrom(q cid.Cid, r *Request, chain []exchange) (*Response, error) {
+	transcript, err := writeTranscript(r, chain)
 	if err != nil {
 		return nil, err
 	}
-
 	return &Response{
 		Query:      q,
 		req:        r,
-		Transcript: buf.Bytes(),
+		Transcript: transcript,
 	}, nil
 }
@@ -0,0 +1,125 @@
+package gemipfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"time"
+
+	"github.com/CorentinB/warc"
+	"github.com/google/uuid"
+)
+
+// exchange is one request and response made while fetching. A transcript
+// holds every exchange leading to the final response, so it shows where the
+// response came from as well as what it was.
+type exchange struct {
+	uri string
+	// req is the request as sent, if known.
+	req  []byte
+	resp []byte
+	// ip is the address connected to, if known.
+	ip  string
+	tls *tls.ConnectionState
+}
+
+func newExchange(req []byte, hr *http.Response, ip string) (*exchange, error) {
+	dump, err := httputil.DumpResponse(hr, true)
+	if err != nil {
+		return nil, err
+	}
+	x := exchange{req: req, resp: dump, ip: ip, tls: hr.TLS}
+	if hr.Request != nil {
+		x.uri = hr.Request.URL.String()
+	}
+	return &x, nil
+}
+
+// writeTranscript writes the exchanges as warc records. Each response is
+// followed by the request that asked for it and a metadata record of the
+// connection, both linked to it by WARC-Concurrent-To. The final response
+// keeps the request's record id.
+func writeTranscript(r *Request, chain []exchange) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	writer := &warc.Writer{
+		FileName:    "",
+		Compression: "",
+		FileWriter:  bufio.NewWriter(buf),
+	}
+	for i, x := range chain {
+		id := uuid.New()
+		if i == len(chain)-1 {
+			id = r.UUID
+		}
+		uri := x.uri
+		if uri == "" {
+			uri = r.URL.String()
+		}
+		resp := newRecord(r, "response", uri, id.String(), "application/http; msgtype=response", x.resp)
+		records := []*warc.Record{resp}
+		if x.req != nil {
+			records = append(records, newRecord(r, "request", uri, uuid.New().String(), "application/http; msgtype=request", x.req))
+		}
+		if md := x.metadata(); md != nil {
+			records = append(records, newRecord(r, "metadata", uri, uuid.New().String(), "application/warc-fields", md))
+		}
+		for _, rec := range records {
+			if x.ip != "" {
+				rec.Header.Set("WARC-IP-Address", x.ip)
+			}
+			if rec != resp {
+				rec.Header.Set("WARC-Concurrent-To", resp.Header.Get("WARC-Record-ID"))
+			}
+			if _, err := writer.WriteRecord(rec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// metadata describes the connection an exchange was made on, as warc
+// fields. Peer certificates are base64 DER, leaf first.
+func (x *exchange) metadata() []byte {
+	if x.ip == "" && x.tls == nil {
+		return nil
+	}
+	buf := bytes.NewBuffer(nil)
+	if x.ip != "" {
+		fmt.Fprintf(buf, "ip-address: %s\r\n", x.ip)
+	}
+	if cs := x.tls; cs != nil {
+		fmt.Fprintf(buf, "tls-version: %s\r\n", tls.VersionName(cs.Version))
+		fmt.Fprintf(buf, "tls-cipher-suite: %s\r\n", tls.CipherSuiteName(cs.CipherSuite))
+		if cs.ServerName != "" {
+			fmt.Fprintf(buf, "tls-server-name: %s\r\n", cs.ServerName)
+		}
+		if cs.NegotiatedProtocol != "" {
+			fmt.Fprintf(buf, "tls-negotiated-protocol: %s\r\n", cs.NegotiatedProtocol)
+		}
+		for _, c := range cs.PeerCertificates {
+			fmt.Fprintf(buf, "peer-certificate: %s\r\n", base64.StdEncoding.EncodeToString(c.Raw))
+		}
+	}
+	return buf.Bytes()
+}
+
+func newRecord(r *Request, warcType, uri, id, contentType string, content []byte) *warc.Record {
+	digest := "sha1:" + warc.GetSHA1(bytes.NewReader(content))
+	rec := warc.NewRecord(os.TempDir(), false)
+	rec.Header.Set("WARC-Type", warcType)
+	rec.Header.Set("WARC-Payload-Digest", digest)
+	rec.Header.Set("WARC-Block-Digest", digest)
+	rec.Header.Set("WARC-Target-URI", uri)
+	rec.Header.Set("WARC-Date", r.Time.UTC().Format(time.RFC3339Nano))
+	rec.Header.Set("WARC-Record-ID", "<urn:uuid:"+id+">")
+	rec.Header.Set("Host", r.URL.Host)
+	rec.Header.Set("Content-Type", contentType)
+	rec.Content.Write(content)
+	return rec
+}
@@ -0,0 +1,314 @@
+package gemipfs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	pb "github.com/libp2p/go-libp2p/core/crypto/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// Exits prove that a trusted service lets them relay queries with a UCAN
+// (https://github.com/ucan-wg/spec, v0.10) delegation chain ending at the
+// exit's peer key.
+const (
+	UCANVersion = "0.10.0"
+	// ExitAbility is the capability an exit needs from the service.
+	ExitAbility = "gemipfs/exit"
+	// ExitAuthProtocol serves an exit's delegation chain, leaf first, as
+	// newline separated tokens.
+	ExitAuthProtocol = "/gemipfs/exit/auth/0.0.1"
+)
+
+var ErrInvalidUCAN = errors.New("invalid ucan")
+
+// Capability is a UCAN attenuation.
+type Capability struct {
+	With string `json:"with"`
+	Can  string `json:"can"`
+}
+
+type ucanHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Ucv string `json:"ucv"`
+}
+
+type ucanPayload struct {
+	Iss string       `json:"iss"`
+	Aud string       `json:"aud"`
+	Nbf int64        `json:"nbf,omitempty"`
+	Exp *int64       `json:"exp"`
+	Att []Capability `json:"att"`
+	Prf []string     `json:"prf"`
+}
+
+// UCAN is a parsed and signature checked token.
+type UCAN struct {
+	Issuer       string
+	Audience     string
+	NotBefore    time.Time
+	Expiry       time.Time
+	Capabilities []Capability
+	Proofs       []cid.Cid
+
+	raw string
+}
+
+// IssueUCAN delegates capabilities from the holder of sk to the audience
+// DID. Proofs are the tokens the issuer holds that grant the capabilities.
+// A zero expiry never expires.
+func IssueUCAN(sk crypto.PrivKey, audience string, att []Capability, expiry time.Time, proofs ...*UCAN) (*UCAN, error) {
+	if sk.Type() != pb.KeyType_Ed25519 {
+		return nil, fmt.Errorf("unsupported ucan key type: %s", sk.Type())
+	}
+	iss, err := DIDFromPubKey(sk.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	p := ucanPayload{Iss: iss, Aud: audience, Att: att, Prf: []string{}}
+	if !expiry.IsZero() {
+		exp := expiry.Unix()
+		p.Exp = &exp
+	}
+	for _, prf := range proofs {
+		p.Prf = append(p.Prf, prf.CID().String())
+	}
+	hb, err := json.Marshal(ucanHeader{Alg: "EdDSA", Typ: "JWT", Ucv: UCANVersion})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := sk.Sign([]byte(signed))
+	if err != nil {
+		return nil, err
+	}
+	return ParseUCAN(signed + "." + base64.RawURLEncoding.EncodeToString(sig))
+}
+
+// ParseUCAN decodes a token and checks it is signed by its issuer. Time
+// bounds and proofs are checked when verifying a chain.
+func ParseUCAN(token string) (*UCAN, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidUCAN
+	}
+	var h ucanHeader
+	if err := decodeJWTPart(parts[0], &h); err != nil {
+		return nil, err
+	}
+	if h.Alg != "EdDSA" || h.Ucv == "" {
+		return nil, fmt.Errorf("%w: unsupported header %+v", ErrInvalidUCAN, h)
+	}
+	var p ucanPayload
+	if err := decodeJWTPart(parts[1], &p); err != nil {
+		return nil, err
+	}
+	pk, err := PubKeyFromDID(p.Iss)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUCAN, err)
+	}
+	if ok, err := pk.Verify([]byte(parts[0]+"."+parts[1]), sig); err != nil || !ok {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidUCAN)
+	}
+
+	u := UCAN{
+		Issuer:       p.Iss,
+		Audience:     p.Aud,
+		Capabilities: p.Att,
+		raw:          strings.TrimSpace(token),
+	}
+	if p.Nbf != 0 {
+		u.NotBefore = time.Unix(p.Nbf, 0)
+	}
+	if p.Exp != nil {
+		u.Expiry = time.Unix(*p.Exp, 0)
+	}
+	for _, prf := range p.Prf {
+		c, err := cid.Decode(prf)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad proof: %v", ErrInvalidUCAN, err)
+		}
+		u.Proofs = append(u.Proofs, c)
+	}
+	return &u, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidUCAN, err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidUCAN, err)
+	}
+	return nil
+}
+
+func (u *UCAN) String() string {
+	return u.raw
+}
+
+// CID is how other tokens refer to this one as a proof.
+func (u *UCAN) CID() cid.Cid {
+	mh, _ := multihash.Sum([]byte(u.raw), multihash.SHA2_256, -1)
+	return cid.NewCidV1(uint64(multicodec.Raw), mh)
+}
+
+func (u *UCAN) grants(c Capability) bool {
+	for _, att := range u.Capabilities {
+		if (att.With == c.With || att.With == "*") && (att.Can == c.Can || att.Can == "*") {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *UCAN) activeAt(t time.Time) bool {
+	if !u.NotBefore.IsZero() && t.Before(u.NotBefore) {
+		return false
+	}
+	return u.Expiry.IsZero() || t.Before(u.Expiry)
+}
+
+// ParseUCANChain reads newline separated tokens.
+func ParseUCANChain(b []byte) ([]*UCAN, error) {
+	var chain []*UCAN
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		u, err := ParseUCAN(string(line))
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, u)
+	}
+	return chain, nil
+}
+
+// MarshalUCANChain writes tokens one per line.
+func MarshalUCANChain(chain []*UCAN) []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, u := range chain {
+		buf.WriteString(u.raw)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// VerifyExitDelegation checks that the chain, leaf first, delegates the
+// exit ability on the service from the service DID down to the exit.
+func VerifyExitDelegation(chain []*UCAN, service string, exit peer.ID, now time.Time) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("%w: empty delegation", ErrInvalidUCAN)
+	}
+	pk, err := exit.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	exitDID, err := DIDFromPubKey(pk)
+	if err != nil {
+		return err
+	}
+	want := Capability{With: service, Can: ExitAbility}
+	audience := exitDID
+	for i, u := range chain {
+		if u.Audience != audience {
+			return fmt.Errorf("%w: link %d is for %s, not %s", ErrInvalidUCAN, i, u.Audience, audience)
+		}
+		if !u.activeAt(now) {
+			return fmt.Errorf("%w: link %d is not valid now", ErrInvalidUCAN, i)
+		}
+		if !u.grants(want) {
+			return fmt.Errorf("%w: link %d does not grant %s", ErrInvalidUCAN, i, ExitAbility)
+		}
+		if i+1 < len(chain) {
+			if !hasProof(u, chain[i+1].CID()) {
+				return fmt.Errorf("%w: link %d does not cite its proof", ErrInvalidUCAN, i)
+			}
+			if !u.within(chain[i+1]) {
+				return fmt.Errorf("%w: link %d outlives its proof", ErrInvalidUCAN, i)
+			}
+		}
+		audience = u.Issuer
+	}
+	if audience != service {
+		return fmt.Errorf("%w: chain is rooted at %s, not %s", ErrInvalidUCAN, audience, service)
+	}
+	return nil
+}
+
+// within is whether u is only valid while its parent is, since a
+// delegation can't grant more time than it was given.
+func (u *UCAN) within(parent *UCAN) bool {
+	if !parent.NotBefore.IsZero() && (u.NotBefore.IsZero() || u.NotBefore.Before(parent.NotBefore)) {
+		return false
+	}
+	if !parent.Expiry.IsZero() && (u.Expiry.IsZero() || u.Expiry.After(parent.Expiry)) {
+		return false
+	}
+	return true
+}
+
+func hasProof(u *UCAN, c cid.Cid) bool {
+	for _, p := range u.Proofs {
+		if p.Equals(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// DIDFromPubKey is the did:key form of an ed25519 key.
+func DIDFromPubKey(pk crypto.PubKey) (string, error) {
+	if pk.Type() != pb.KeyType_Ed25519 {
+		return "", fmt.Errorf("unsupported did key type: %s", pk.Type())
+	}
+	raw, err := pk.Raw()
+	if err != nil {
+		return "", err
+	}
+	b := binary.AppendUvarint(nil, uint64(multicodec.Ed25519Pub))
+	s, err := multibase.Encode(multibase.Base58BTC, append(b, raw...))
+	if err != nil {
+		return "", err
+	}
+	return "did:key:" + s, nil
+}
+
+// PubKeyFromDID parses a did:key for an ed25519 key.
+func PubKeyFromDID(did string) (crypto.PubKey, error) {
+	mb, ok := strings.CutPrefix(did, "did:key:")
+	if !ok {
+		return nil, fmt.Errorf("unsupported did: %s", did)
+	}
+	_, b, err := multibase.Decode(mb)
+	if err != nil {
+		return nil, err
+	}
+	code, n := binary.Uvarint(b)
+	if n <= 0 || code != uint64(multicodec.Ed25519Pub) {
+		return nil, fmt.Errorf("unsupported did key type: %s", did)
+	}
+	return crypto.UnmarshalEd25519PublicKey(b[n:])
+}
@@ -1,40 +1,55 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/rand"
-	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"net/http"
-	"net/netip"
 	"net/url"
 	"path"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/elazarl/goproxy"
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
-	"github.com/libp2p/go-libp2p/core/crypto"
-	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/core/sec"
-	"github.com/multiformats/go-multiaddr"
-	manet "github.com/multiformats/go-multiaddr/net"
 	gemipfs "github.com/willscott/go-gemipfs/lib"
 	"github.com/willscott/go-gemipfs/router"
+	"golang.org/x/sync/singleflight"
 )
 
+// coalescedTimeout bounds a query shared by identical requests, since it
+// doesn't end with any one of them.
+const coalescedTimeout = time.Minute
+
 func main() {
 	verbose := flag.Bool("v", false, "should every proxy request be logged to stdout")
 	addr := flag.String("addr", ":8080", "proxy listen address")
-	resolverAddr := flag.String("remote", "127.0.0.1:8081", "where the resolver lives")
-	repoAddr := flag.String("repo", "http://127.0.0.1:8082", "where the repo lives")
+	resolverAddr := flag.String("remote", "", "exits to use, as /p2p/ multiaddrs or with -tofu as host:port (comma separated for fallback exits)")
+	tofu := flag.Bool("tofu", false, "trust the peer id of exits given without one on first use, and pin it from then on")
+	race := flag.Bool("race", false, "send each query to all exits at once rather than failing over in order")
+	repoAddr := flag.String("repo", "http://127.0.0.1:8082", "where the repo lives (comma separated in order of preference, empty to have exits respond directly)")
 	storeLoc := flag.String("store", "./", "where to store data")
+	identity := flag.String("identity", "", "libp2p identity of the client (default <store>/.gemipfs/identity, created if missing)")
+	padding := flag.String("padding", "padme", "query padding policy (none, padme, or a bucket size in bytes)")
+	issuer := flag.String("issuer", "", "privacy pass issuer to get exit and repo tokens from")
+	issuerCredential := flag.String("issuer-credential", "", "credential shown to the privacy pass issuer to be given tokens")
+	service := flag.String("service", "", "DIDs of the services exits must hold a UCAN delegation from (comma separated)")
+	discover := flag.Bool("discover", false, "use exits announced on pubsub that are authorized by a -service")
+	bootstrap := flag.String("bootstrap", "", "comma separated /p2p multiaddrs to join the announcement topic through")
+	privateSites := flag.String("private-sites", "", "comma separated domains whose cookies and credentials are sent through exits, with responses kept private (others have them stripped)")
+	directSites := flag.String("direct-sites", "", "comma separated domains connected to directly, bypassing gemipfs")
 	flag.Parse()
 
+	padPolicy, err := gemipfs.ParsePaddingPolicy(*padding)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
 	storeBaseLoc := path.Join(*storeLoc, ".gemipfs")
 	store := gemipfs.NewCarStore(storeBaseLoc)
 	rConf := router.RouterConfig{
@@ -46,126 +61,267 @@ func main() {
 		log.Fatal(err)
 		return
 	}
-	host, err := libp2p.New()
-	if err != nil {
-		log.Fatal(err)
-		return
+	if *identity == "" {
+		*identity = path.Join(storeBaseLoc, "identity")
 	}
-	rh, rp, err := net.SplitHostPort(*resolverAddr)
+	sk, err := gemipfs.LoadOrCreateIdentity(*identity)
 	if err != nil {
-		log.Fatalf("could not parse host %s: %v\n", *resolverAddr, err)
+		log.Fatalf("could not load identity: %v\n", err)
 		return
 	}
-	peer, err := connectToPeer(context.Background(), host, rh, rp)
+	host, err := libp2p.New(libp2p.Identity(sk))
 	if err != nil {
-		log.Fatalf("could not connect: %v\n", err)
+		log.Fatal(err)
 		return
 	}
-	repoUrl, err := url.Parse(*repoAddr)
-	if err != nil {
-		log.Fatalf("couldn't parse repo: %v\n", err)
+	exits := make([]peer.ID, 0, 1)
+	var known *knownExits
+	if *tofu {
+		known, err = loadKnownExits(path.Join(storeBaseLoc, "known_exits"))
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
+	for _, remote := range strings.Split(*resolverAddr, ",") {
+		if remote == "" {
+			continue
+		}
+		exit, err := connectToExit(context.Background(), host, remote, known)
+		if err != nil {
+			log.Fatalf("could not connect: %v\n", err)
+			return
+		}
+		exits = append(exits, exit)
+	}
+	var services []string
+	var delegations map[peer.ID]cid.Cid
+	if *service != "" {
+		services = strings.Split(*service, ",")
+		exits, delegations = authorizedExits(context.Background(), host, exits, services)
+	}
+	var disc *discovery
+	if *discover {
+		if len(services) == 0 {
+			log.Fatal("discovery needs a -service to trust exits from")
+			return
+		}
+		disc, err = startDiscovery(context.Background(), host, services, *bootstrap)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+	} else if len(exits) == 0 {
+		log.Fatal("no usable exits")
 		return
 	}
+	pool := newExitPool(host, exits, delegations, disc)
+	go pool.checkHealth(context.Background())
+	var repos []gemipfs.Location
+	if *repoAddr != "" {
+		for _, r := range strings.Split(*repoAddr, ",") {
+			l, err := gemipfs.ParseLocation(r)
+			if err != nil {
+				log.Fatalf("couldn't parse repo: %v\n", err)
+				return
+			}
+			repos = append(repos, l)
+		}
+	}
+	var wallet *gemipfs.TokenWallet
+	if *issuer != "" {
+		u, err := url.Parse(*issuer)
+		if err != nil {
+			log.Fatalf("couldn't parse issuer: %v\n", err)
+			return
+		}
+		wallet, err = gemipfs.NewTokenWallet(context.Background(), u, *issuerCredential)
+		if err != nil {
+			log.Fatalf("couldn't load token issuer: %v\n", err)
+			return
+		}
+	}
+
+	creds := newCredentialPolicy(*privateSites, *directSites)
+	prefetched := newPrefetchIndex(store)
+	var inflight singleflight.Group
 
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.CertStore = NewCertStorage()
 	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
 	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		action := creds.action(req.URL.Hostname())
+		if action == credDirect {
+			// the proxy makes the request itself.
+			return req, nil
+		}
 		gr, err := gemipfs.Wrap(req)
 		if err != nil {
 			log.Printf("could not wrap req: %v\n", err)
 			return nil, nil
 		}
-		request, err := gr.Canonicalize().Serialize()
+		gr = gr.Canonicalize()
+		if action == credStrip {
+			gr.StripCredentials()
+		}
+		request, err := gr.Serialize()
 		if err != nil {
 			log.Printf("could not serialize req to peer: %v\n", err)
 			return nil, nil
 		}
+		// private requests, with side effects or credentials, or to sites
+		// whose credentials are passed on, are only ever answered by an exit,
+		// directly to us.
+		public := action != credPrivate && gr.Public()
+		if public {
+			if hResp, ok := prefetched.lookup(req, gr); ok {
+				// pushed to us along with an earlier page.
+				return req, hResp
+			}
+		}
 		contentSearchKey := gr.DomainHash()
 		query, err := gemipfs.DecodedQueryFromRequest(request)
 		if err != nil {
 			log.Printf("couldn't transform query: %v\n", err)
 			return nil, nil
 		}
+		replyRepos := repos
+		if !public {
+			replyRepos = nil
+		}
 
 		contentRouter := router.NewRouter(host, &rConf)
 
-		// First, see if there's an existing repo with the content
-		peers := contentRouter.FindRepos(req.Context(), contentSearchKey)
-		storedResp, err := router.WithFirstToResolve(req.Context(), contentRouter, query, peers)
-		if err == nil {
-			// return from an existing repo
-			rb, err := store.Get(storedResp)
-			if err != nil {
-				log.Printf("could not retrieve response from store: %v\n", err)
-				return nil, nil
-			}
-			gResp, err := gemipfs.ResponseFromWARC(query.Resource, req, rb)
-			if err != nil {
-				log.Printf("could not parse response from store: %v\n", err)
-				return nil, nil
+		// First, see if there's an existing repo with the content. No repo
+		// holds responses to private requests, so they aren't looked for.
+		if public {
+			peers := contentRouter.FindRepos(req.Context(), contentSearchKey)
+			storedResp, err := router.WithFirstToResolve(req.Context(), contentRouter, query, peers)
+			if err == nil {
+				// return from an existing repo
+				rb, err := store.Get(storedResp)
+				if err != nil {
+					log.Printf("could not retrieve response from store: %v\n", err)
+					return nil, nil
+				}
+				gResp, err := gemipfs.ResponseFromWARC(query.Resource, req, rb)
+				if err != nil {
+					log.Printf("could not parse response from store: %v\n", err)
+					return nil, nil
+				}
+				hResp, err := gResp.HTTP(req)
+				if err != nil {
+					log.Printf("could not convert response to http: %v\n", err)
+					return nil, nil
+				}
+				return req, hResp
 			}
-			hResp, err := gResp.HTTP(req)
-			if err != nil {
-				log.Printf("could not convert response to http: %v\n", err)
-				return nil, nil
-			}
-			return req, hResp
 		}
 		log.Printf("going to relay for %s\n", contentSearchKey)
 
 		// no store identified - use an exit to request the page.
-		query.Repo = repoUrl
-		wireQuery, err := query.EncryptTo(peer)
-		if err != nil {
-			log.Printf("could not serialize req to peer: %v\n", err)
-			return nil, nil
-		}
-		netCtx, netCncl := context.WithCancel(req.Context())
-		defer netCncl()
-		stream, err := host.NewStream(netCtx, peer, "/exit/0.0.1")
-		if err != nil {
-			log.Print(err)
-			return nil, nil
-		}
-		defer stream.Close()
-		if err := wireQuery.Write(stream); err != nil {
-			log.Print(err)
-			return nil, nil
-		}
-		stream.CloseWrite()
-		fmt.Printf("waiting for response for %s\n", req.URL)
+		relay := func(ctx context.Context) (*gemipfs.Response, error) {
+			query.Repos = replyRepos
+			query.Padding = padPolicy
+			// a fresh reply key for each query, so exits can't link them.
+			session, err := gemipfs.NewSessionKey()
+			if err != nil {
+				return nil, fmt.Errorf("could not make reply key: %w", err)
+			}
+			query.ReplyKey = session.Public()
+			query.RepoTokens = nil
+			if wallet != nil {
+				// tokens are bound to the repo or exit they pay.
+				for _, l := range replyRepos {
+					t, err := wallet.Token(ctx, l.Origin())
+					if err != nil {
+						return nil, fmt.Errorf("could not get repo token: %w", err)
+					}
+					query.RepoTokens = append(query.RepoTokens, t)
+				}
+			}
+			// each exit asked gets its own copy of the query, carrying its token.
+			encrypt := func(ctx context.Context, e peer.ID) (*gemipfs.Query, error) {
+				eq := *query
+				if wallet != nil {
+					var err error
+					if eq.ExitToken, err = wallet.Token(ctx, e.String()); err != nil {
+						return nil, fmt.Errorf("could not get exit token: %w", err)
+					}
+				}
+				exitPubKeys, err := exitKeys(host, []peer.ID{e})
+				if err != nil {
+					return nil, fmt.Errorf("could not get exit keys: %w", err)
+				}
+				wireQuery, err := eq.EncryptToKeys(exitPubKeys...)
+				if err != nil {
+					return nil, fmt.Errorf("could not serialize req to peer: %w", err)
+				}
+				return wireQuery, nil
+			}
+			candidates := pool.exits(requiredCaps(replyRepos)...)
+			fmt.Printf("waiting for response for %s\n", req.URL)
+			reply, exit, err := pool.ask(ctx, candidates, encrypt, session, *race)
+			if err != nil {
+				return nil, fmt.Errorf("could not get response attestation: %w", err)
+			}
+			// the pool has checked the attestation is the exit's, for this query.
+			attest := reply.Attestation
 
-		ioR, err := io.ReadAll(stream)
-		if err != nil {
-			log.Printf("did not get attestion response for %s\n", req.URL)
-			return nil, nil
-		}
-		if len(ioR) == 0 {
-			log.Printf("no attestion response for %s\n", req.URL)
-			return nil, nil
-		}
-		attest, err := gemipfs.ParseAttestation(ioR)
-		if err != nil {
-			log.Printf("could not parse response attestation for %s - %v\n", req.URL, err)
-			return nil, nil
-		}
-		//fmt.Printf("got attestation %+v\n", attest)
-		//TODO: validate the attestion.
+			encResp := reply.Response
+			if encResp == nil && reply.Bundle != nil {
+				locs := attest.Locations
+				if len(locs) == 0 {
+					locs = repos
+				}
+				if err := prefetched.add(ctx, host, exit, locs, *reply.Bundle); err != nil {
+					log.Printf("could not get bundle %s: %v\n", reply.Bundle, err)
+				} else if b, err := store.Get(attest.Resp); err == nil {
+					encResp = b
+				}
+			}
+			if encResp == nil {
+				// Get resp from repo.
+				locs := attest.Locations
+				if len(locs) == 0 {
+					locs = repos
+				}
+				encResp, err = fetchResponse(ctx, host, locs, attest.Resp)
+				if err != nil {
+					return nil, fmt.Errorf("could not get response from repo: %w", err)
+				}
+			}
 
-		// Get resp from repo.
-		log.Printf("resp is at %s\n", repoUrl.String()+"?cid="+attest.Resp.String())
-		encResp, err := http.Get(repoUrl.String() + "?cid=" + attest.Resp.String())
-		if err != nil {
-			log.Printf("could not get response from repo: %v\n", err)
-			return nil, nil
+			resp, err := gemipfs.ReadResponse(attest.Req, bytes.NewReader(encResp))
+			if err != nil {
+				return nil, fmt.Errorf("could not parse response: %w", err)
+			}
+			return resp, nil
 		}
 
-		resp, err := gemipfs.ReadResponse(attest.Req, encResp.Body)
-		if err != nil {
-			log.Printf("could not parse response from repo: %v\n", encResp)
-			log.Print(err)
-			return nil, nil
+		var resp *gemipfs.Response
+		if public {
+			// identical requests in flight share one query. The query
+			// outlives any one of the requests waiting on it.
+			v, err, shared := inflight.Do(gr.VariantKey(), func() (interface{}, error) {
+				ctx, cncl := context.WithTimeout(context.WithoutCancel(req.Context()), coalescedTimeout)
+				defer cncl()
+				return relay(ctx)
+			})
+			if err != nil {
+				log.Printf("could not relay %s: %v\n", req.URL, err)
+				return nil, nil
+			}
+			if shared {
+				log.Printf("coalesced request for %s\n", req.URL)
+			}
+			resp = v.(*gemipfs.Response)
+		} else {
+			resp, err = relay(req.Context())
+			if err != nil {
+				log.Printf("could not relay %s: %v\n", req.URL, err)
+				return nil, nil
+			}
 		}
 		hResp, err := resp.HTTP(req)
 		if err != nil {
@@ -174,35 +330,13 @@ func main() {
 		}
 		return req, hResp
 	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		// responses may be shared, so cookies they set aren't this browser's.
+		if resp != nil && creds.action(ctx.Req.URL.Hostname()) == credStrip {
+			resp.Header.Del("Set-Cookie")
+		}
+		return resp
+	})
 	proxy.Verbose = *verbose
 	log.Fatal(http.ListenAndServe(*addr, proxy))
 }
-
-func connectToPeer(ctx context.Context, h host.Host, host string, port string) (peer.ID, error) {
-	// make a synthetic id to connect to first
-	_, fakePub, _ := crypto.GenerateEd25519Key(rand.Reader)
-	fakeID, _ := peer.IDFromPublicKey(fakePub)
-	hostAddr, err := netip.ParseAddr(host)
-	if err != nil {
-		return "", err
-	}
-	portInt, err := strconv.Atoi(port)
-	if err != nil {
-		return "", err
-	}
-	hostPortAddr := netip.AddrPortFrom(hostAddr, uint16(portInt))
-	ma, err := manet.FromNetAddr(net.TCPAddrFromAddrPort(hostPortAddr))
-	if err != nil {
-		return "", err
-	}
-	err = h.Connect(ctx, peer.AddrInfo{ID: fakeID, Addrs: []multiaddr.Multiaddr{ma}})
-	if err != nil {
-		misMatchErr := sec.ErrPeerIDMismatch{}
-		if !errors.As(err, &misMatchErr) {
-			return "", err
-		}
-		err = h.Connect(ctx, peer.AddrInfo{ID: misMatchErr.Actual, Addrs: []multiaddr.Multiaddr{ma}})
-		return misMatchErr.Actual, err
-	}
-	return "", nil
-}
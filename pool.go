@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+const (
+	healthInterval = 15 * time.Second
+	healthTimeout  = 5 * time.Second
+	// exits that keep failing are skipped for a backoff that doubles with
+	// each failure, up to maxExitBackoff.
+	minExitBackoff = time.Second
+	maxExitBackoff = time.Minute
+	// latencyWeight is how much a new sample moves the latency average.
+	latencyWeight = 0.2
+)
+
+type exitHealth struct {
+	latency  time.Duration
+	inflight int
+	failures int
+	retryAt  time.Time
+
+	successes uint64
+	errors    uint64
+}
+
+func (eh *exitHealth) healthy(now time.Time) bool {
+	return !now.Before(eh.retryAt)
+}
+
+// score orders exits by expected time to answer, spreading queries away
+// from exits that are already busy or often fail.
+func (eh *exitHealth) score() time.Duration {
+	// exits that haven't answered yet score zero, so each gets measured.
+	l := eh.latency
+	errRate := 0.0
+	if total := eh.successes + eh.errors; total > 0 {
+		errRate = float64(eh.errors) / float64(total)
+	}
+	return time.Duration(float64(l) * float64(1+eh.inflight) * (1 + 4*errRate))
+}
+
+// exitPool tracks the health of the configured and discovered exits and
+// spreads queries across them.
+type exitPool struct {
+	h      host.Host
+	static []peer.ID
+	disc   *discovery
+	// delegations, when set, are the delegations the static exits must
+	// attest under. Discovered exits attest under the one they announced.
+	delegations map[peer.ID]cid.Cid
+
+	mtx    sync.Mutex
+	health map[peer.ID]*exitHealth
+}
+
+func newExitPool(h host.Host, static []peer.ID, delegations map[peer.ID]cid.Cid, disc *discovery) *exitPool {
+	return &exitPool{
+		h:           h,
+		static:      static,
+		disc:        disc,
+		delegations: delegations,
+		health:      make(map[peer.ID]*exitHealth),
+	}
+}
+
+// delegation is the delegation an exit must attest under, or nil if exits
+// aren't required to hold one.
+func (p *exitPool) delegation(e peer.ID) (*cid.Cid, error) {
+	if p.delegations == nil && p.disc == nil {
+		return nil, nil
+	}
+	if d, ok := p.delegations[e]; ok {
+		return &d, nil
+	}
+	if p.disc != nil {
+		if d, ok := p.disc.Delegation(e); ok {
+			return &d, nil
+		}
+	}
+	return nil, fmt.Errorf("no delegation known for exit %s", e)
+}
+
+func (p *exitPool) get(e peer.ID) *exitHealth {
+	eh, ok := p.health[e]
+	if !ok {
+		eh = &exitHealth{}
+		p.health[e] = eh
+	}
+	return eh
+}
+
+// exits lists the exits able to serve a query with the capabilities, best
+// first. Exits in backoff are kept at the end as a last resort.
+func (p *exitPool) exits(caps ...string) []peer.ID {
+	all := p.static
+	if p.disc != nil {
+		all = appendNew(all, p.disc.Exits(caps...)...)
+	}
+	all = append([]peer.ID{}, all...)
+	rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	now := time.Now()
+	sort.SliceStable(all, func(i, j int) bool {
+		hi, hj := p.get(all[i]), p.get(all[j])
+		if hi.healthy(now) != hj.healthy(now) {
+			return hi.healthy(now)
+		}
+		return hi.score() < hj.score()
+	})
+	return all
+}
+
+func (p *exitPool) start(e peer.ID) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.get(e).inflight++
+}
+
+// done records the outcome of a query. A busy exit is only held off for as
+// long as it asks; any other error, including those the exit reports, counts
+// against it.
+func (p *exitPool) done(e peer.ID, took time.Duration, err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	eh := p.get(e)
+	eh.inflight--
+	var re *gemipfs.ReplyError
+	if errors.As(err, &re) && re.Status == gemipfs.ReplyBusy {
+		// a busy exit is up, but shouldn't be sent more until it asks.
+		eh.retryAt = time.Now().Add(re.RetryAfter)
+		log.Printf("exit %s busy for %s: %v\n", e, re.RetryAfter, err)
+		return
+	}
+	if err != nil {
+		p.failed(e, eh, err)
+		return
+	}
+	p.succeeded(eh, took)
+}
+
+func (p *exitPool) failed(e peer.ID, eh *exitHealth, err error) {
+	eh.errors++
+	eh.failures++
+	backoff := minExitBackoff << min(eh.failures-1, 16)
+	if backoff > maxExitBackoff {
+		backoff = maxExitBackoff
+	}
+	eh.retryAt = time.Now().Add(backoff)
+	log.Printf("exit %s unhealthy for %s: %v\n", e, backoff, err)
+}
+
+func (p *exitPool) succeeded(eh *exitHealth, took time.Duration) {
+	eh.successes++
+	p.recovered(eh)
+	if eh.latency == 0 {
+		eh.latency = took
+	} else {
+		eh.latency += time.Duration(latencyWeight * float64(took-eh.latency))
+	}
+}
+
+func (p *exitPool) recovered(eh *exitHealth) {
+	eh.failures = 0
+	eh.retryAt = time.Time{}
+}
+
+// checkHealth periodically re-dials and pings every known exit, so exits
+// that went away are noticed, and come back, without a query failing.
+func (p *exitPool) checkHealth(ctx context.Context) {
+	t := time.NewTicker(healthInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		var wg sync.WaitGroup
+		for _, e := range p.exits() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.check(ctx, e)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func (p *exitPool) check(ctx context.Context, e peer.ID) {
+	ctx, cncl := context.WithTimeout(ctx, healthTimeout)
+	defer cncl()
+	if p.h.Network().Connectedness(e) != network.Connected {
+		if err := p.h.Connect(ctx, p.h.Peerstore().PeerInfo(e)); err != nil {
+			p.mtx.Lock()
+			p.failed(e, p.get(e), err)
+			p.mtx.Unlock()
+			return
+		}
+	}
+	res := <-ping.Ping(ctx, p.h, e)
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if res.Error != nil {
+		p.failed(e, p.get(e), res.Error)
+		return
+	}
+	// pings only show the exit is up; they say little about how long a
+	// query takes.
+	p.recovered(p.get(e))
+}
+
+// queryFor encrypts a query for one exit.
+type queryFor func(ctx context.Context, e peer.ID) (*gemipfs.Query, error)
+
+// ask sends a query to one or more of the exits, encrypting it for each as
+// it is sent. When racing, all exits are asked at once and the first
+// attestation wins; otherwise they are tried best first until one answers.
+// The exit that answered is returned with its reply.
+func (p *exitPool) ask(ctx context.Context, exits []peer.ID, q queryFor, sk *gemipfs.SessionKey, race bool) (*gemipfs.Reply, peer.ID, error) {
+	if len(exits) == 0 {
+		return nil, "", errors.New("no exits available")
+	}
+	if !race {
+		var errs []error
+		for _, e := range exits {
+			a, err := p.askExit(ctx, e, q, sk)
+			if err == nil {
+				return a, e, nil
+			}
+			log.Printf("exit %s failed: %v\n", e, err)
+			errs = append(errs, err)
+		}
+		return nil, "", errors.Join(errs...)
+	}
+
+	raceCtx, cncl := context.WithCancel(ctx)
+	defer cncl()
+	type result struct {
+		a   *gemipfs.Reply
+		e   peer.ID
+		err error
+	}
+	results := make(chan result, len(exits))
+	for _, e := range exits {
+		go func() {
+			a, err := p.askExit(raceCtx, e, q, sk)
+			results <- result{a, e, err}
+		}()
+	}
+	var errs []error
+	for range exits {
+		r := <-results
+		if r.err == nil {
+			// the first answer wins; the other exits are cancelled.
+			return r.a, r.e, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+func (p *exitPool) askExit(ctx context.Context, e peer.ID, q queryFor, sk *gemipfs.SessionKey) (*gemipfs.Reply, error) {
+	wq, err := q(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	p.start(e)
+	start := time.Now()
+	a, err := askExit(ctx, p.h, e, wq, sk)
+	if err == nil {
+		var d *cid.Cid
+		if d, err = p.delegation(e); err == nil {
+			err = checkAttestation(p.h, e, wq, a.Attestation, d)
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		// cancelled by the caller, or beaten in a race; not the exit's fault.
+		p.mtx.Lock()
+		p.get(e).inflight--
+		p.mtx.Unlock()
+		return nil, err
+	}
+	p.done(e, time.Since(start), err)
+	return a, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+// announce periodically publishes the exit's announcement on the exit
+// topic. Announcements outlive a few missed rounds before clients drop
+// them.
+func (e *exit) announce(ctx context.Context, interval time.Duration, bootstrap string, issuer string) error {
+	for _, b := range strings.Split(bootstrap, ",") {
+		if b == "" {
+			continue
+		}
+		ai, err := peer.AddrInfoFromString(b)
+		if err != nil {
+			return err
+		}
+		if err := e.host.Connect(ctx, *ai); err != nil {
+			log.Printf("could not connect to bootstrap peer %s: %v\n", b, err)
+		}
+	}
+	ps, err := pubsub.NewGossipSub(ctx, e.host)
+	if err != nil {
+		return err
+	}
+	topic, err := gemipfs.JoinExitTopic(ps)
+	if err != nil {
+		return err
+	}
+	// subscribing puts the exit in the mesh, so it forwards the
+	// announcements of other exits.
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Cancel()
+		for {
+			if _, err := sub.Next(ctx); err != nil {
+				return
+			}
+		}
+	}()
+	if len(e.attester.Delegation) == 0 {
+		log.Printf("announcing without a delegation; clients will ignore this exit\n")
+	}
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			a := e.announcement(issuer, time.Now().Add(3*interval))
+			b, err := a.Bytes()
+			if err == nil {
+				err = topic.Publish(ctx, b)
+			}
+			if err != nil {
+				log.Printf("failed to announce: %v\n", err)
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (e *exit) announcement(issuer string, expires time.Time) *gemipfs.ExitAnnouncement {
+	a := gemipfs.ExitAnnouncement{
+		Peer:         e.host.ID(),
+		Capabilities: []string{gemipfs.CapDirect, gemipfs.CapStoreHTTP, gemipfs.CapStoreLibP2P},
+		TokenIssuer:  issuer,
+		Expires:      expires,
+	}
+	for _, ma := range e.host.Addrs() {
+		a.Addrs = append(a.Addrs, ma.String())
+	}
+	for _, u := range e.attester.Delegation {
+		a.Delegation = append(a.Delegation, u.String())
+	}
+	return &a
+}
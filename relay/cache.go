@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/go-cid"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+const verifyTimeout = 5 * time.Second
+
+// cachedResponse is an answer the exit has already given, which can be
+// given again while it is fresh.
+type cachedResponse struct {
+	attestation *gemipfs.Attestation
+	expires     time.Time
+	// body is kept for responses up to the cache's maxBody, so they can be
+	// delivered directly or stored in other repos without a refetch.
+	body []byte
+
+	mtx  sync.Mutex
+	locs []gemipfs.Location
+}
+
+// responseCache maps recent queries to the attested responses they got.
+// Queries are keyed by what they were sealed to and the request they
+// carry, headers and all, since only the same request under the same key
+// gets the same response.
+type responseCache struct {
+	entries *lru.Cache[string, *cachedResponse]
+	maxBody int
+	// verify checks that a repo still has a response before pointing a
+	// client to it.
+	verify bool
+}
+
+func newResponseCache(size int, maxBody int, verify bool) *responseCache {
+	entries, err := lru.New[string, *cachedResponse](size)
+	if err != nil {
+		return nil
+	}
+	return &responseCache{entries: entries, maxBody: maxBody, verify: verify}
+}
+
+func cacheKey(q *gemipfs.Query, req *gemipfs.Request) string {
+	return q.Resource.KeyString() + req.VariantKey()
+}
+
+func (rc *responseCache) get(key string) *cachedResponse {
+	cr, ok := rc.entries.Get(key)
+	if !ok {
+		return nil
+	}
+	if time.Now().After(cr.expires) {
+		rc.entries.Remove(key)
+		return nil
+	}
+	return cr
+}
+
+func (rc *responseCache) add(key string, resp *gemipfs.Response, prf *gemipfs.Attestation, body []byte) {
+	ttl := resp.Expiry()
+	if ttl <= 0 || resp.SetsCookies() {
+		return
+	}
+	cr := &cachedResponse{
+		attestation: prf,
+		expires:     time.Now().Add(ttl),
+		locs:        prf.Locations,
+	}
+	if len(body) <= rc.maxBody {
+		cr.body = body
+	}
+	rc.entries.Add(key, cr)
+}
+
+// cachedAnswer answers a query from the cache, pointing the client to a
+// repo that already has the response, or storing a cached response where
+// the client asks. It returns nil on a miss.
+func (e *exit) cachedAnswer(key string, dq *gemipfs.DecodedQuery) *gemipfs.Reply {
+	cr := e.cache.get(key)
+	if cr == nil {
+		return nil
+	}
+	prf := *cr.attestation
+	if len(dq.Repos) == 0 {
+		if cr.body == nil {
+			return nil
+		}
+		prf.Locations = nil
+		return &gemipfs.Reply{Status: gemipfs.ReplyOK, Attestation: &prf, Response: cr.body}
+	}
+
+	cr.mtx.Lock()
+	locs := slices.Clone(cr.locs)
+	cr.mtx.Unlock()
+	for _, l := range dq.Repos {
+		if !slices.Contains(locs, l) {
+			continue
+		}
+		if e.cache.verify {
+			if err := e.hasResponse(l, prf.Resp); err != nil {
+				log.Printf("cached response %s is gone from %s: %v", prf.Resp, l, err)
+				continue
+			}
+		}
+		log.Printf("answering from cache with %s at %s", prf.Resp, l)
+		prf.Locations = []gemipfs.Location{l}
+		return &gemipfs.Reply{Status: gemipfs.ReplyOK, Attestation: &prf}
+	}
+
+	if cr.body == nil {
+		return nil
+	}
+	stored, err := e.storeResponse(dq.Repos, prf.Resp, cr.body, dq.RepoTokens)
+	if err != nil {
+		log.Printf("failed to post cached response to repo: %v", err)
+		return &gemipfs.Reply{Status: gemipfs.ReplyStoreFailed, Message: err.Error()}
+	}
+	cr.mtx.Lock()
+	for _, l := range stored {
+		if !slices.Contains(cr.locs, l) {
+			cr.locs = append(cr.locs, l)
+		}
+	}
+	cr.mtx.Unlock()
+	log.Printf("answering from cache with %s, stored at %s", prf.Resp, stored)
+	prf.Locations = stored
+	return &gemipfs.Reply{Status: gemipfs.ReplyOK, Attestation: &prf}
+}
+
+// hasResponse checks that a repo still holds a response.
+func (e *exit) hasResponse(l gemipfs.Location, c cid.Cid) error {
+	ctx, cncl := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cncl()
+	if l.IsLibP2P() {
+		ai, err := l.AddrInfo()
+		if err != nil {
+			return err
+		}
+		_, err = gemipfs.GetFromRepo(ctx, e.host, *ai, c)
+		return err
+	}
+	u, err := l.URL()
+	if err != nil {
+		return err
+	}
+	u = u.JoinPath("ipfs", c.String())
+	u.RawQuery = "format=raw"
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("repo responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+// loadDelegation reads the exit's UCAN chain. A chain ending at an operator
+// key is extended to the exit's peer key with that key, so the exit's key
+// can be rotated without going back to the service.
+func (e *exit) loadDelegation(chainFile, keyFile string) error {
+	b, err := os.ReadFile(chainFile)
+	if err != nil {
+		return err
+	}
+	chain, err := gemipfs.ParseUCANChain(b)
+	if err != nil {
+		return err
+	}
+	if len(chain) == 0 {
+		return fmt.Errorf("no delegation in %s", chainFile)
+	}
+	service := chain[len(chain)-1].Issuer
+	exitDID, err := gemipfs.DIDFromPubKey(e.host.Peerstore().PubKey(e.host.ID()))
+	if err != nil {
+		return err
+	}
+	if chain[0].Audience != exitDID && keyFile != "" {
+		sk, err := gemipfs.LoadIdentity(keyFile)
+		if err != nil {
+			return err
+		}
+		leaf, err := gemipfs.IssueUCAN(sk, exitDID, []gemipfs.Capability{{With: service, Can: gemipfs.ExitAbility}}, chain[0].Expiry, chain[0])
+		if err != nil {
+			return err
+		}
+		chain = append([]*gemipfs.UCAN{leaf}, chain...)
+	}
+	if err := gemipfs.VerifyExitDelegation(chain, service, e.host.ID(), time.Now()); err != nil {
+		return err
+	}
+	log.Printf("exit authorized by %s\n", service)
+	e.attester.Delegation = chain
+	e.host.SetStreamHandler(gemipfs.ExitAuthProtocol, e.serveDelegation)
+	return nil
+}
+
+func (e *exit) serveDelegation(s network.Stream) {
+	defer s.Close()
+	if _, err := s.Write(gemipfs.MarshalUCANChain(e.attester.Delegation)); err != nil {
+		log.Printf("failed to write delegation: %v", err)
+	}
+}
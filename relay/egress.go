@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+
+	"github.com/quic-go/quic-go"
+)
+
+// errEgressDenied is returned for requests the exit's egress policy does not
+// allow.
+var errEgressDenied = errors.New("denied by egress policy")
+
+// deniedPrefixes are ranges netip doesn't count as private that still reach
+// hosts the exit shouldn't: "this network" (which linux dials as local), the
+// shared address space of RFC 6598, and the NAT64 prefix, through which any
+// IPv4 address can be reached.
+var deniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// egressPolicy limits where an exit will fetch from on behalf of clients, so
+// it can't be used to reach hosts on its own network.
+type egressPolicy struct {
+	// allowPrivate permits loopback, private and link-local destinations.
+	allowPrivate bool
+	// allow, when not empty, is the only domains (and their subdomains)
+	// that can be fetched. deny takes precedence over it.
+	allow   []string
+	deny    []string
+	ports   map[string]bool
+	methods map[string]bool
+}
+
+func parseDomains(s string) []string {
+	var domains []string
+	for _, d := range strings.Split(s, ",") {
+		if d = normalizeHost(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+func parseSet(s string, canon func(string) string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[canon(v)] = true
+		}
+	}
+	return set
+}
+
+func normalizeHost(h string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")
+}
+
+func matchesDomain(host string, domains []string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequest checks what a request asks for. The address a name reaches
+// is only known once it is dialed, and is checked then.
+func (p *egressPolicy) checkRequest(r *http.Request) error {
+	if !p.methods[r.Method] {
+		return fmt.Errorf("method %s %w", r.Method, errEgressDenied)
+	}
+	if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+		return fmt.Errorf("scheme %s %w", r.URL.Scheme, errEgressDenied)
+	}
+	port := r.URL.Port()
+	if port == "" {
+		port = "80"
+		if r.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if !p.ports[port] {
+		return fmt.Errorf("port %s %w", port, errEgressDenied)
+	}
+	host := normalizeHost(r.URL.Hostname())
+	if matchesDomain(host, p.deny) {
+		return fmt.Errorf("host %s %w", host, errEgressDenied)
+	}
+	if len(p.allow) > 0 && !matchesDomain(host, p.allow) {
+		return fmt.Errorf("host %s %w", host, errEgressDenied)
+	}
+	// addresses are checked again when dialed, except through a proxy.
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return p.checkIP(ip)
+	}
+	return nil
+}
+
+// checkAddr checks an address about to be dialed.
+func (p *egressPolicy) checkAddr(address string) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	return p.checkIP(ap.Addr())
+}
+
+func (p *egressPolicy) checkIP(ip netip.Addr) error {
+	ip = ip.Unmap()
+	if p.allowPrivate {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("address %s %w", ip, errEgressDenied)
+	}
+	for _, d := range deniedPrefixes {
+		if d.Contains(ip) {
+			return fmt.Errorf("address %s %w", ip, errEgressDenied)
+		}
+	}
+	return nil
+}
+
+// control checks each address after it is resolved, as it is dialed, so a
+// name can't be rebound to an internal address between a check and the
+// connection.
+func (p *egressPolicy) control(network, address string, _ syscall.RawConn) error {
+	return p.checkAddr(address)
+}
+
+// dialQUIC resolves and checks an address for HTTP/3, which doesn't dial
+// through a net.Dialer.
+func (p *egressPolicy) dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range ips {
+		checked := net.JoinHostPort(ip.Unmap().String(), port)
+		if err := p.checkAddr(checked); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		conn, err := quic.DialAddrEarly(ctx, checked, tlsCfg, cfg)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// egressTransport checks every request made through it, including those
+// following redirects.
+type egressTransport struct {
+	policy *egressPolicy
+	base   http.RoundTripper
+}
+
+func (t *egressTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if err := t.policy.checkRequest(r); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(r)
+}
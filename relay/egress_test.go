@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answers lookups of the names it holds over udp, so dials can be
+// made through names resolving to any address.
+func fakeDNS(t *testing.T, names map[string]netip.Addr) *net.Resolver {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) == 0 {
+				continue
+			}
+			q := msg.Questions[0]
+			msg.Header.Response = true
+			msg.Header.Authoritative = true
+			if ip, ok := names[strings.TrimSuffix(q.Name.String(), ".")]; ok {
+				hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}
+				switch {
+				case q.Type == dnsmessage.TypeA && ip.Is4():
+					msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: ip.As4()}})
+				case q.Type == dnsmessage.TypeAAAA && ip.Is6():
+					msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: ip.As16()}})
+				}
+			} else {
+				msg.Header.RCode = dnsmessage.RCodeNameError
+			}
+			out, err := msg.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(out, from)
+		}
+	}()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", pc.LocalAddr().String())
+		},
+	}
+}
+
+func TestEgressDial(t *testing.T) {
+	names := map[string]netip.Addr{
+		"loopback.test":   netip.MustParseAddr("127.0.0.1"),
+		"metadata.test":   netip.MustParseAddr("169.254.169.254"),
+		"rfc1918.test":    netip.MustParseAddr("10.1.2.3"),
+		"lan.test":        netip.MustParseAddr("192.168.1.1"),
+		"ula.test":        netip.MustParseAddr("fd00::1"),
+		"thisnet.test":    netip.MustParseAddr("0.1.2.3"),
+		"nat64.test":      netip.MustParseAddr("64:ff9b::a01:203"),
+		"mapped.test":     netip.MustParseAddr("::ffff:127.0.0.1"),
+		"public.test":     netip.MustParseAddr("192.0.2.1"),
+		"public6.test":    netip.MustParseAddr("2001:db8::1"),
+		"carriernat.test": netip.MustParseAddr("100.64.0.1"),
+	}
+	p := &egressPolicy{}
+	d := &net.Dialer{
+		Resolver: fakeDNS(t, names),
+		Control:  p.control,
+		Timeout:  200 * time.Millisecond,
+	}
+
+	for _, name := range []string{"loopback.test", "metadata.test", "rfc1918.test", "lan.test", "ula.test", "thisnet.test", "nat64.test", "mapped.test", "carriernat.test"} {
+		t.Run(name, func(t *testing.T) {
+			c, err := d.Dial("tcp", net.JoinHostPort(name, "80"))
+			if err == nil {
+				c.Close()
+			}
+			if !errors.Is(err, errEgressDenied) {
+				t.Fatalf("dial to %s (%s) got %v, want %v", name, names[name], err, errEgressDenied)
+			}
+		})
+	}
+	for _, name := range []string{"public.test", "public6.test"} {
+		t.Run(name, func(t *testing.T) {
+			// the address is unreachable here; the dial just mustn't be refused.
+			c, err := d.Dial("tcp", net.JoinHostPort(name, "80"))
+			if err == nil {
+				c.Close()
+			}
+			var dnsErr *net.DNSError
+			if errors.Is(err, errEgressDenied) || errors.As(err, &dnsErr) {
+				t.Fatalf("dial to %s (%s) was refused: %v", name, names[name], err)
+			}
+		})
+	}
+}
+
+func TestEgressAllowPrivate(t *testing.T) {
+	p := &egressPolicy{allowPrivate: true}
+	for _, a := range []string{"127.0.0.1", "169.254.169.254", "10.1.2.3", "fd00::1"} {
+		if err := p.checkIP(netip.MustParseAddr(a)); err != nil {
+			t.Errorf("%s refused: %v", a, err)
+		}
+	}
+}
+
+func testPolicy(allow, deny, ports, methods string) *egressPolicy {
+	return &egressPolicy{
+		allow:   parseDomains(allow),
+		deny:    parseDomains(deny),
+		ports:   parseSet(ports, strings.TrimSpace),
+		methods: parseSet(methods, strings.ToUpper),
+	}
+}
+
+func TestEgressCheckRequest(t *testing.T) {
+	open := testPolicy("", "", "80,443", "get,head")
+	listed := testPolicy("example.com, Allowed.TEST.", "bad.example.com,evil.test", "80,443", "GET")
+	for _, tc := range []struct {
+		name   string
+		policy *egressPolicy
+		method string
+		url    string
+		denied bool
+	}{
+		{"allowed", listed, "GET", "http://example.com/", false},
+		{"allowed subdomain", listed, "GET", "https://www.example.com/a", false},
+		{"not allowed", listed, "GET", "http://example.org/", true},
+		{"suffix isn't a subdomain", listed, "GET", "http://notexample.com/", true},
+		{"deny over allow", listed, "GET", "http://bad.example.com/", true},
+		{"deny over allow subdomain", listed, "GET", "http://a.bad.example.com/", true},
+		{"denied without allow list", testPolicy("", "evil.test", "80", "GET"), "GET", "http://www.evil.test/", true},
+		{"normalized allow entry", listed, "GET", "http://allowed.test/", false},
+		{"uppercase host", listed, "GET", "http://WWW.EXAMPLE.COM/", false},
+		{"trailing dot host", listed, "GET", "http://example.com./", false},
+		{"uppercase denied host", listed, "GET", "http://BAD.Example.COM/", true},
+		{"trailing dot denied host", listed, "GET", "http://bad.example.com./", true},
+		{"http default port", testPolicy("", "", "80", "GET"), "GET", "http://example.com/", false},
+		{"https default port", testPolicy("", "", "443", "GET"), "GET", "https://example.com/", false},
+		{"http default port not allowed", testPolicy("", "", "443", "GET"), "GET", "http://example.com/", true},
+		{"https default port not allowed", testPolicy("", "", "80", "GET"), "GET", "https://example.com/", true},
+		{"explicit default port", testPolicy("", "", "443", "GET"), "GET", "https://example.com:443/", false},
+		{"other port", open, "GET", "http://example.com:8080/", true},
+		{"other scheme", open, "GET", "ftp://example.com/", true},
+		{"allowed method", open, "HEAD", "http://example.com/", false},
+		{"disallowed method", open, "POST", "http://example.com/", true},
+		{"disallowed method in allow list", listed, "DELETE", "http://example.com/", true},
+		{"public ip", open, "GET", "http://192.0.2.1/", false},
+		{"public ipv6", open, "GET", "http://[2001:db8::1]/", false},
+		{"loopback ip", open, "GET", "http://127.0.0.1/", true},
+		{"loopback ipv6", open, "GET", "http://[::1]:80/", true},
+		{"private ip", open, "GET", "http://10.0.0.1/", true},
+		{"metadata ip", open, "GET", "http://169.254.169.254/latest/", true},
+		{"mapped ip", open, "GET", "http://[::ffff:10.0.0.1]/", true},
+		{"nat64 ip", open, "GET", "http://[64:ff9b::a00:1]/", true},
+		{"unspecified ip", open, "GET", "http://0.0.0.0/", true},
+		{"private ip allowed", &egressPolicy{allowPrivate: true, ports: open.ports, methods: open.methods}, "GET", "http://127.0.0.1/", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := http.NewRequest(tc.method, tc.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tc.policy.checkRequest(r)
+			if tc.denied && !errors.Is(err, errEgressDenied) {
+				t.Fatalf("%s %s got %v, want %v", tc.method, tc.url, err, errEgressDenied)
+			}
+			if !tc.denied && err != nil {
+				t.Fatalf("%s %s refused: %v", tc.method, tc.url, err)
+			}
+		})
+	}
+}
+
+func TestEgressRedirect(t *testing.T) {
+	fetched := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched <- r.URL.Path
+		http.Redirect(w, r, "http://internal.test/admin", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	// the origin is on loopback, so private addresses are allowed here.
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := testPolicy("", "internal.test", "80,"+u.Port(), "GET")
+	p.allowPrivate = true
+	client := &http.Client{Transport: &egressTransport{policy: p, base: http.DefaultTransport}}
+
+	resp, err := client.Get(origin.URL + "/start")
+	if err == nil {
+		resp.Body.Close()
+	}
+	if !errors.Is(err, errEgressDenied) {
+		t.Fatalf("redirect got %v, want %v", err, errEgressDenied)
+	}
+	if got := <-fetched; got != "/start" {
+		t.Fatalf("origin fetched %s", got)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// h3Backoff is how long an origin that failed over HTTP/3 is fetched over
+// TCP before HTTP/3 is tried again.
+const h3Backoff = time.Hour
+
+// fetchConfig is how an exit makes requests to origins.
+type fetchConfig struct {
+	// timeout bounds a whole fetch, including reading the body.
+	timeout       time.Duration
+	dialTimeout   time.Duration
+	tlsTimeout    time.Duration
+	headerTimeout time.Duration
+	// maxBody is the largest response body that is fetched; 0 is unlimited.
+	maxBody int64
+	// redirects is how many redirects are followed. Past that, the redirect
+	// itself is the response.
+	redirects int
+	// proxy, when set, is an http, https or socks5 proxy that origins are
+	// fetched through, such as a local Tor daemon.
+	proxy *url.URL
+	http2 bool
+	// http3 tries https origins over HTTP/3 first, falling back to TCP.
+	http3 bool
+	tls   *tls.Config
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown tls version: %s", s)
+}
+
+// loadTLSConfig makes the TLS configuration for origins, trusting the
+// certificates in caFile instead of the system roots if it is set.
+func loadTLSConfig(minVersion string, caFile string) (*tls.Config, error) {
+	v, err := parseTLSVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{MinVersion: v}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	return cfg, nil
+}
+
+// client makes an http client that fetches within the egress policy.
+func (fc *fetchConfig) client(egress *egressPolicy) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   fc.dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	tr := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       fc.tls,
+		TLSHandshakeTimeout:   fc.tlsTimeout,
+		ResponseHeaderTimeout: fc.headerTimeout,
+		ForceAttemptHTTP2:     fc.http2,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if fc.proxy != nil {
+		if fc.http3 {
+			return nil, errors.New("http/3 can't be used through a proxy")
+		}
+		// only the proxy is dialed, and it resolves names itself, so
+		// addresses are only checked when a url holds one.
+		tr.Proxy = http.ProxyURL(fc.proxy)
+	} else {
+		// an environment proxy would be dialed instead of the origin, and
+		// the origin's address never checked.
+		dialer.Control = egress.control
+	}
+	if !fc.http2 {
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	var rt http.RoundTripper = tr
+	if fc.http3 {
+		rt = &h3Transport{
+			h3: &http3.Transport{
+				TLSClientConfig: fc.tls,
+				QUICConfig:      &quic.Config{HandshakeIdleTimeout: fc.dialTimeout},
+				Dial:            egress.dialQUIC,
+			},
+			tcp:    tr,
+			failed: make(map[string]time.Time),
+		}
+	}
+	if fc.maxBody > 0 {
+		rt = &limitTransport{rt, fc.maxBody}
+	}
+	return &http.Client{
+		Transport:     &egressTransport{egress, rt},
+		Timeout:       fc.timeout,
+		CheckRedirect: fc.checkRedirect,
+	}, nil
+}
+
+func (fc *fetchConfig) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > fc.redirects {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+// h3Transport fetches https origins over HTTP/3 where they support it,
+// remembering those that don't.
+type h3Transport struct {
+	h3  *http3.Transport
+	tcp http.RoundTripper
+
+	mtx    sync.Mutex
+	failed map[string]time.Time
+}
+
+func (t *h3Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// requests with a body can't be retried over TCP once it is read.
+	if r.URL.Scheme != "https" || (r.Body != nil && r.Body != http.NoBody) || !t.try(r.URL.Host) {
+		return t.tcp.RoundTrip(r)
+	}
+	resp, err := t.h3.RoundTrip(r)
+	if err == nil || errors.Is(err, errEgressDenied) || r.Context().Err() != nil {
+		return resp, err
+	}
+	log.Printf("falling back to tcp for %s: %v\n", r.URL.Host, err)
+	t.mtx.Lock()
+	t.failed[r.URL.Host] = time.Now()
+	t.mtx.Unlock()
+	return t.tcp.RoundTrip(r)
+}
+
+func (t *h3Transport) try(host string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	at, ok := t.failed[host]
+	if ok && time.Since(at) > h3Backoff {
+		delete(t.failed, host)
+		return true
+	}
+	return !ok
+}
+
+// limitTransport fails responses with bodies larger than a limit.
+type limitTransport struct {
+	base http.RoundTripper
+	max  int64
+}
+
+func (t *limitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength > t.max {
+		resp.Body.Close()
+		return nil, fmt.Errorf("response body of %d bytes exceeds %d", resp.ContentLength, t.max)
+	}
+	resp.Body = &limitedBody{resp.Body, t.max, t.max}
+	return resp, nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	max       int64
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// read one byte past the limit, to tell a body that is exactly the limit
+	// from one that is over.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, fmt.Errorf("response body exceeds %d bytes", b.max)
+	}
+	return n, err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// busyRetry is how long clients are asked to wait when the exit has no
+	// free slots for them.
+	busyRetry = time.Second
+	// queryReadTimeout bounds how long a client has to send its query.
+	queryReadTimeout = 10 * time.Second
+	// limiterCacheSize bounds how many peers and domains have rate limiters
+	// kept; those forgotten start again with a full bucket.
+	limiterCacheSize = 4096
+)
+
+// busyError is returned when a query is over a limit. The client is told to
+// wait retryAfter before asking again.
+type busyError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (b *busyError) Error() string {
+	return "exit busy: " + b.reason
+}
+
+// limits bounds the work an exit takes on, overall and for any one client
+// or origin. Queries over a concurrency limit wait in a bounded queue, and
+// queries over a rate wait for their turn, for up to queueTimeout.
+type limits struct {
+	slots        chan struct{}
+	perPeer      int
+	maxQueue     int
+	queueTimeout time.Duration
+
+	peerRate      rate.Limit
+	peerBurst     int
+	domainRate    rate.Limit
+	domainBurst   int
+	peerBuckets   *lru.Cache[peer.ID, *rate.Limiter]
+	domainBuckets *lru.Cache[string, *rate.Limiter]
+
+	mtx     sync.Mutex
+	active  map[peer.ID]int
+	waiting int
+}
+
+// newLimits makes limits with the given number of concurrent queries overall
+// and per peer, and queries per second per peer and per origin domain. Zero
+// leaves a limit off.
+func newLimits(global, perPeer, maxQueue int, queueTimeout time.Duration, peerRate, domainRate float64) *limits {
+	l := &limits{
+		perPeer:      perPeer,
+		maxQueue:     maxQueue,
+		queueTimeout: queueTimeout,
+		peerRate:     rate.Limit(peerRate),
+		peerBurst:    max(1, int(2*peerRate)),
+		domainRate:   rate.Limit(domainRate),
+		domainBurst:  max(1, int(2*domainRate)),
+		active:       make(map[peer.ID]int),
+	}
+	if global > 0 {
+		l.slots = make(chan struct{}, global)
+	}
+	l.peerBuckets, _ = lru.New[peer.ID, *rate.Limiter](limiterCacheSize)
+	l.domainBuckets, _ = lru.New[string, *rate.Limiter](limiterCacheSize)
+	return l
+}
+
+// admit waits for a query from p to be allowed to run, returning a function
+// to call when it is done.
+func (l *limits) admit(ctx context.Context, p peer.ID) (func(), error) {
+	if l.peerRate > 0 {
+		lim := bucket(l.peerBuckets, p, l.peerRate, l.peerBurst)
+		if err := l.wait(ctx, lim, "too many queries from peer"); err != nil {
+			return nil, err
+		}
+	}
+
+	l.mtx.Lock()
+	if l.perPeer > 0 && l.active[p] >= l.perPeer {
+		l.mtx.Unlock()
+		return nil, &busyError{"too many concurrent queries from peer", busyRetry}
+	}
+	l.active[p]++
+	l.mtx.Unlock()
+	release := func() {
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		if l.active[p]--; l.active[p] == 0 {
+			delete(l.active, p)
+		}
+	}
+
+	if l.slots == nil {
+		return release, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots; release() }, nil
+	default:
+	}
+	l.mtx.Lock()
+	if l.waiting >= l.maxQueue {
+		l.mtx.Unlock()
+		release()
+		return nil, &busyError{"queue is full", busyRetry}
+	}
+	l.waiting++
+	l.mtx.Unlock()
+	defer func() {
+		l.mtx.Lock()
+		l.waiting--
+		l.mtx.Unlock()
+	}()
+
+	t := time.NewTimer(l.queueTimeout)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots; release() }, nil
+	case <-t.C:
+		release()
+		return nil, &busyError{"no free slot", busyRetry}
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// waitDomain waits for a fetch from an origin to be allowed by its rate.
+func (l *limits) waitDomain(ctx context.Context, host string) error {
+	if l.domainRate == 0 {
+		return nil
+	}
+	lim := bucket(l.domainBuckets, host, l.domainRate, l.domainBurst)
+	return l.wait(ctx, lim, fmt.Sprintf("too many requests to %s", host))
+}
+
+func bucket[K comparable](c *lru.Cache[K, *rate.Limiter], k K, r rate.Limit, burst int) *rate.Limiter {
+	lim := rate.NewLimiter(r, burst)
+	if prev, ok, _ := c.PeekOrAdd(k, lim); ok {
+		return prev
+	}
+	return lim
+}
+
+// wait takes a token from the bucket, waiting for it if it will be there
+// within the queue timeout.
+func (l *limits) wait(ctx context.Context, lim *rate.Limiter, reason string) error {
+	r := lim.Reserve()
+	if !r.OK() {
+		return &busyError{reason, busyRetry}
+	}
+	d := r.Delay()
+	if d == 0 {
+		return nil
+	}
+	if d > l.queueTimeout {
+		r.Cancel()
+		return &busyError{reason, d}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+// testOrigin holds each request until it is released, counting how many it
+// is holding at once.
+type testOrigin struct {
+	*httptest.Server
+	release chan struct{}
+	entered chan struct{}
+	active  atomic.Int32
+	most    atomic.Int32
+}
+
+func newTestOrigin(t *testing.T) *testOrigin {
+	t.Helper()
+	o := &testOrigin{release: make(chan struct{}), entered: make(chan struct{}, 100)}
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := o.active.Add(1)
+		defer o.active.Add(-1)
+		for m := o.most.Load(); n > m && !o.most.CompareAndSwap(m, n); m = o.most.Load() {
+		}
+		o.entered <- struct{}{}
+		<-o.release
+		io.WriteString(w, "hello")
+	}))
+	t.Cleanup(o.Close)
+	t.Cleanup(o.open)
+	return o
+}
+
+func (o *testOrigin) open() {
+	select {
+	case <-o.release:
+	default:
+		close(o.release)
+	}
+}
+
+// newTestExit serves an exit with the limits over an in-memory network,
+// returning it and the client hosts connected to it.
+func newTestExit(t *testing.T, l *limits, clients int) (*exit, []host.Host) {
+	t.Helper()
+	mn, err := mocknet.FullMeshConnected(clients + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mn.Close() })
+	hosts := mn.Hosts()
+	padding, err := gemipfs.ParsePaddingPolicy("none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &exit{
+		attester: &gemipfs.Attester{Identity: hosts[0].Peerstore().PrivKey(hosts[0].ID())},
+		host:     hosts[0],
+		padding:  padding,
+		client:   http.DefaultClient,
+		limits:   l,
+	}
+	hosts[0].SetStreamHandler("/exit/0.0.1", e.doExit)
+	return e, hosts[1:]
+}
+
+// query sends a private request for u to the exit, returning its reply.
+func query(t *testing.T, e *exit, c host.Host, u string) *gemipfs.Reply {
+	t.Helper()
+	hr, err := http.NewRequest(http.MethodPost, u, strings.NewReader("q"))
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	gr, err := gemipfs.Wrap(hr)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	sr, err := gr.Canonicalize().Serialize()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	dq, err := gemipfs.DecodedQueryFromRequest(sr)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	session, err := gemipfs.NewSessionKey()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	dq.ReplyKey = session.Public()
+	wq, err := dq.EncryptToKeys(e.host.Peerstore().PubKey(e.host.ID()))
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+	s, err := c.NewStream(ctx, e.host.ID(), "/exit/0.0.1")
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	defer s.Close()
+	if err := wq.Write(s); err != nil {
+		t.Error(err)
+		return nil
+	}
+	s.CloseWrite()
+	b, err := io.ReadAll(s)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	reply, err := gemipfs.OpenReply(session, b)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return reply
+}
+
+// queryAll sends a query from each client at once, returning the replies as
+// they come.
+func queryAll(t *testing.T, e *exit, clients []host.Host, u string) <-chan *gemipfs.Reply {
+	replies := make(chan *gemipfs.Reply, len(clients))
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replies <- query(t, e, c, u)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(replies)
+	}()
+	return replies
+}
+
+// expectBusy takes n replies, which must all be busy.
+func expectBusy(t *testing.T, replies <-chan *gemipfs.Reply, n int, retryAfter time.Duration) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case r := <-replies:
+			if r == nil {
+				t.Fatal("query failed")
+			}
+			if r.Status != gemipfs.ReplyBusy {
+				t.Fatalf("got status %v, want busy", r.Status)
+			}
+			if r.RetryAfter < retryAfter {
+				t.Fatalf("asked to retry after %s, want at least %s", r.RetryAfter, retryAfter)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d busy replies, want %d", i, n)
+		}
+	}
+}
+
+// expectOK takes the remaining replies, which must all be answers.
+func expectOK(t *testing.T, replies <-chan *gemipfs.Reply, n int) {
+	t.Helper()
+	got := 0
+	for r := range replies {
+		if r == nil {
+			t.Fatal("query failed")
+		}
+		if r.Status != gemipfs.ReplyOK {
+			t.Fatalf("got status %v (%s), want ok", r.Status, r.Message)
+		}
+		got++
+	}
+	if got != n {
+		t.Fatalf("got %d answers, want %d", got, n)
+	}
+}
+
+func waitEntered(t *testing.T, o *testOrigin, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-o.entered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d queries reached the origin", i, n)
+		}
+	}
+}
+
+func TestPerPeerLimit(t *testing.T) {
+	o := newTestOrigin(t)
+	e, clients := newTestExit(t, newLimits(0, 2, 0, time.Second, 0, 0), 2)
+
+	busy := queryAll(t, e, []host.Host{clients[0], clients[0], clients[0], clients[0], clients[0], clients[0]}, o.URL)
+	waitEntered(t, o, 2)
+	expectBusy(t, busy, 4, busyRetry)
+
+	// the cap is per peer, so another is still served.
+	other := queryAll(t, e, clients[1:], o.URL)
+	waitEntered(t, o, 1)
+
+	o.open()
+	expectOK(t, busy, 2)
+	expectOK(t, other, 1)
+	if most := o.most.Load(); most != 3 {
+		t.Fatalf("origin saw %d queries at once, want 3", most)
+	}
+}
+
+func TestGlobalLimit(t *testing.T) {
+	o := newTestOrigin(t)
+	l := newLimits(3, 0, 2, 10*time.Second, 0, 0)
+	e, clients := newTestExit(t, l, 10)
+
+	// three are answered, two wait in the queue and the rest are turned away.
+	replies := queryAll(t, e, clients, o.URL)
+	waitEntered(t, o, 3)
+	expectBusy(t, replies, 5, busyRetry)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		l.mtx.Lock()
+		waiting := l.waiting
+		l.mtx.Unlock()
+		if waiting == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d queries queued, want 2", waiting)
+		}
+	}
+
+	o.open()
+	expectOK(t, replies, 5)
+	if most := o.most.Load(); most != 3 {
+		t.Fatalf("origin saw %d queries at once, want 3", most)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	o := newTestOrigin(t)
+	e, clients := newTestExit(t, newLimits(1, 0, 1, 50*time.Millisecond, 0, 0), 2)
+
+	first := queryAll(t, e, clients[:1], o.URL)
+	waitEntered(t, o, 1)
+	expectBusy(t, queryAll(t, e, clients[1:], o.URL), 1, busyRetry)
+
+	o.open()
+	expectOK(t, first, 1)
+}
+
+func TestPeerRateLimit(t *testing.T) {
+	o := newTestOrigin(t)
+	o.open()
+	// one query every two seconds, and a burst of one.
+	e, clients := newTestExit(t, newLimits(0, 0, 0, 50*time.Millisecond, 0.5, 0), 2)
+
+	expectOK(t, queryAll(t, e, clients[:1], o.URL), 1)
+	// the bucket won't refill within the queue timeout, so the client is
+	// told when it will have.
+	expectBusy(t, queryAll(t, e, clients[:1], o.URL), 1, time.Second)
+	// other peers have their own bucket.
+	expectOK(t, queryAll(t, e, clients[1:], o.URL), 1)
+}
@@ -1,27 +1,77 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 	manet "github.com/multiformats/go-multiaddr/net"
 	gemipfs "github.com/willscott/go-gemipfs/lib"
+	"golang.org/x/sync/singleflight"
 )
 
 func main() {
 	addr := flag.String("addr", ":8080", "proxy listen address")
+	identity := flag.String("identity", "exit.key", "libp2p identity of the exit (created if missing)")
+	padding := flag.String("padding", "padme", "response padding policy (none, padme, or a bucket size in bytes)")
+	issuer := flag.String("issuer", "", "privacy pass issuer whose tokens are required for queries")
+	spent := flag.String("spent", "exit.spent", "where redeemed privacy pass tokens are recorded")
+	delegation := flag.String("delegation", "", "file of UCANs, leaf first, authorizing this exit")
+	delegationKey := flag.String("delegationkey", "", "libp2p private key the delegation is addressed to, used to extend it to this exit")
+	announce := flag.Duration("announce", 0, "how often to announce this exit on pubsub (0 to not announce)")
+	bootstrap := flag.String("bootstrap", "", "comma separated /p2p multiaddrs to join the announcement topic through")
+	prefetch := flag.Int("prefetch", 0, "number of subresources to prefetch with each page (0 to not prefetch)")
+	prefetchKinds := flag.String("prefetch-kinds", "style,script,image,font", "comma separated kinds of subresource to prefetch")
+	prefetchCrossOrigin := flag.Bool("prefetch-cross-origin", false, "prefetch subresources from other origins than the page")
+	prefetchMaxBytes := flag.Int("prefetch-max-bytes", 1<<20, "largest subresource response to prefetch")
+	egressAllow := flag.String("egress-allow", "", "comma separated domains to only allow fetching from (with their subdomains)")
+	egressDeny := flag.String("egress-deny", "", "comma separated domains to never fetch from (with their subdomains)")
+	egressPorts := flag.String("egress-ports", "80,443", "comma separated origin ports that can be fetched from")
+	egressMethods := flag.String("egress-methods", "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS", "comma separated request methods that can be made")
+	egressPrivate := flag.Bool("egress-private", false, "allow fetching from loopback, private and link-local addresses")
+	fetchTimeout := flag.Duration("fetch-timeout", 30*time.Second, "longest a fetch from an origin can take, including its body")
+	dialTimeout := flag.Duration("dial-timeout", 10*time.Second, "longest connecting to an origin can take")
+	tlsTimeout := flag.Duration("tls-timeout", 10*time.Second, "longest a tls handshake with an origin can take")
+	headerTimeout := flag.Duration("header-timeout", 10*time.Second, "longest an origin can take to send response headers")
+	maxBody := flag.Int64("max-body", 16<<20, "largest response body to fetch (0 for no limit)")
+	redirects := flag.Int("redirects", 10, "number of redirects to follow (0 to return redirects to the client)")
+	upstreamProxy := flag.String("upstream-proxy", "", "http, https or socks5 proxy to fetch origins through, such as socks5://127.0.0.1:9050 for tor")
+	http2 := flag.Bool("http2", true, "use http/2 with origins that support it")
+	http3 := flag.Bool("http3", false, "try https origins over http/3 first, falling back to tcp")
+	tlsMin := flag.String("tls-min", "1.2", "minimum tls version for origins (1.0, 1.1, 1.2 or 1.3)")
+	tlsCA := flag.String("tls-ca", "", "pem file of certificates to trust for origins instead of the system roots")
+	maxQueries := flag.Int("max-queries", 64, "queries answered at once (0 for no limit)")
+	maxPeerQueries := flag.Int("max-peer-queries", 8, "queries answered at once for any one client (0 for no limit)")
+	maxQueue := flag.Int("queue", 128, "queries waiting for a free slot before more are turned away")
+	queueTimeout := flag.Duration("queue-timeout", 5*time.Second, "longest a query waits for a slot or its turn under a rate limit")
+	peerRate := flag.Float64("peer-rate", 10, "queries per second allowed from any one client (0 for no limit)")
+	domainRate := flag.Float64("domain-rate", 5, "requests per second made to any one origin domain (0 for no limit)")
+	cacheSize := flag.Int("cache", 1024, "number of recent answers to reuse for repeat queries (0 to not cache)")
+	cacheMaxBody := flag.Int("cache-max-body", 1<<20, "largest encrypted response kept in the cache, rather than only where it was stored")
+	cacheVerify := flag.Bool("cache-verify", false, "check a repo still has a cached response before pointing clients to it")
 	flag.Parse()
 
+	padPolicy, err := gemipfs.ParsePaddingPolicy(*padding)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
 	rh, rp, err := net.SplitHostPort(*addr)
 	if err != nil {
 		log.Fatalf("could not parse host %s: %v\n", *addr, err)
@@ -43,64 +93,364 @@ func main() {
 		return
 	}
 
-	host, err := libp2p.New(libp2p.ListenAddrs(ma))
+	sk, err := gemipfs.LoadOrCreateIdentity(*identity)
+	if err != nil {
+		log.Fatalf("could not load identity: %v\n", err)
+		return
+	}
+	host, err := libp2p.New(libp2p.ListenAddrs(ma), libp2p.Identity(sk))
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	e := exit{
+		attester: &gemipfs.Attester{
+			Identity: sk,
+		},
+		host:    host,
+		padding: padPolicy,
+		prefetchPolicy: prefetchPolicy{
+			max:         *prefetch,
+			crossOrigin: *prefetchCrossOrigin,
+			maxBytes:    *prefetchMaxBytes,
+		},
+	}
+	egress := egressPolicy{
+		allowPrivate: *egressPrivate,
+		allow:        parseDomains(*egressAllow),
+		deny:         parseDomains(*egressDeny),
+		ports:        parseSet(*egressPorts, strings.TrimSpace),
+		methods:      parseSet(*egressMethods, strings.ToUpper),
+	}
+	fc := fetchConfig{
+		timeout:       *fetchTimeout,
+		dialTimeout:   *dialTimeout,
+		tlsTimeout:    *tlsTimeout,
+		headerTimeout: *headerTimeout,
+		maxBody:       *maxBody,
+		redirects:     *redirects,
+		http2:         *http2,
+		http3:         *http3,
+	}
+	if *upstreamProxy != "" {
+		if fc.proxy, err = url.Parse(*upstreamProxy); err != nil {
+			log.Fatalf("could not parse upstream proxy: %v\n", err)
+			return
+		}
+	}
+	if fc.tls, err = loadTLSConfig(*tlsMin, *tlsCA); err != nil {
+		log.Fatalf("could not load tls config: %v\n", err)
+		return
+	}
+	if *cacheSize > 0 {
+		e.cache = newResponseCache(*cacheSize, *cacheMaxBody, *cacheVerify)
+	}
+	e.limits = newLimits(*maxQueries, *maxPeerQueries, *maxQueue, *queueTimeout, *peerRate, *domainRate)
+	if e.client, err = fc.client(&egress); err != nil {
+		log.Fatal(err)
+		return
+	}
+	e.prefetchPolicy.kinds, err = parsePrefetchKinds(*prefetchKinds)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
-	myID := gemipfs.Attester{
-		Identity: host.Peerstore().PrivKey(host.ID()),
+	// queries from clients that haven't seen the last rotation are still
+	// encrypted to the previous identity.
+	e.previous, err = gemipfs.LoadIdentity(gemipfs.PreviousIdentityPath(*identity))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatalf("could not load previous identity: %v\n", err)
+		return
+	}
+	handoffs, err := gemipfs.LoadHandoffs(*identity)
+	if err == nil {
+		err = gemipfs.ServeHandoffs(host, handoffs)
+	}
+	if err != nil {
+		log.Fatalf("could not load identity handoffs: %v\n", err)
+		return
+	}
+	if *delegation != "" {
+		if err := e.loadDelegation(*delegation, *delegationKey); err != nil {
+			log.Fatalf("could not load delegation: %v\n", err)
+			return
+		}
+	}
+	if *issuer != "" {
+		// tokens are bound to the exit, including as it was known before the
+		// last rotation.
+		ids := []peer.ID{host.ID()}
+		if e.previous != nil {
+			if prev, err := peer.IDFromPrivateKey(e.previous); err == nil {
+				ids = append(ids, prev)
+			}
+		}
+		e.tokens, err = loadVerifier(*issuer, *spent, ids)
+		if err != nil {
+			log.Fatalf("could not load token issuer %s: %v\n", *issuer, err)
+			return
+		}
 	}
 
-	exitFunc := func(s network.Stream) {
-		doExit(&myID, s)
+	host.SetStreamHandler("/exit/0.0.1", e.doExit)
+	if *announce > 0 {
+		if err := e.announce(context.Background(), *announce, *bootstrap, *issuer); err != nil {
+			log.Fatalf("could not announce exit: %v\n", err)
+			return
+		}
+	}
+	for _, a := range host.Addrs() {
+		log.Printf("exit at %s/p2p/%s\n", a, host.ID())
 	}
-	host.SetStreamHandler("/exit/0.0.1", exitFunc)
 	<-make(chan struct{})
 }
 
-func doExit(a *gemipfs.Attester, s network.Stream) {
+type exit struct {
+	attester *gemipfs.Attester
+	host     host.Host
+	padding  gemipfs.PaddingPolicy
+	previous crypto.PrivKey
+	// tokens, when set, must be redeemed by each query.
+	tokens *gemipfs.TokenVerifier
+	// client fetches from origins within the egress policy.
+	client *http.Client
+	limits *limits
+	// cache, when set, holds recent answers to give again.
+	cache *responseCache
+	// inflight coalesces identical queries being answered at once.
+	inflight singleflight.Group
+	prefetchPolicy
+}
+
+// busyReply asks the client to back off after a query was turned away by
+// the exit's limits.
+func busyReply(err error) *gemipfs.Reply {
+	reply := gemipfs.Reply{Status: gemipfs.ReplyBusy, Message: err.Error(), RetryAfter: busyRetry}
+	var busy *busyError
+	if errors.As(err, &busy) {
+		reply.RetryAfter = busy.retryAfter
+	}
+	return &reply
+}
+
+// answerWithBundle stores the response along with its page's subresources.
+// It returns nil if the page has none to prefetch, or the bundle could not
+// be stored, in which case the response is stored alone.
+func (e *exit) answerWithBundle(req *gemipfs.Request, resp *gemipfs.Response, prf *gemipfs.Attestation, respBody []byte, dq *gemipfs.DecodedQuery) *gemipfs.Reply {
+	entries := e.prefetch(req, resp)
+	if len(entries) == 0 {
+		return nil
+	}
+	bundle := gemipfs.Bundle{Entries: append([]gemipfs.BundleEntry{{Attestation: prf, Body: respBody}}, entries...)}
+	root, car, err := bundle.Car()
+	if err != nil {
+		log.Printf("could not make bundle: %v", err)
+		return nil
+	}
+	locs, err := e.storeBundle(dq.Repos, root, car, dq.RepoTokens)
+	if err != nil {
+		log.Printf("failed to post bundle to repo: %v", err)
+		return nil
+	}
+	prf.Locations = locs
+	return &gemipfs.Reply{Status: gemipfs.ReplyOK, Attestation: prf, Bundle: &root}
+}
+
+func loadVerifier(issuer string, spent string, ids []peer.ID) (*gemipfs.TokenVerifier, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+	tk, _, err := gemipfs.FetchTokenKey(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	challenges := make([]gemipfs.TokenChallenge, 0, len(ids))
+	for _, id := range ids {
+		challenges = append(challenges, gemipfs.TokenChallengeFor(id.String()))
+	}
+	return gemipfs.NewTokenVerifier(tk, spent, challenges...)
+}
+
+func (e *exit) doExit(s network.Stream) {
+	defer s.Close()
+	// queries are small; don't let slow senders hold streams open.
+	s.SetReadDeadline(time.Now().Add(queryReadTimeout))
 	q, err := gemipfs.ReadQuery(s)
 	if err != nil {
 		log.Printf("could not read query: %v", err)
 		return
 	}
-	dq, err := q.TryDecrypt(a.Identity)
+	dq, err := q.TryDecrypt(e.attester.Identity)
+	if err != nil && e.previous != nil {
+		dq, err = q.TryDecrypt(e.previous)
+	}
 	if err != nil {
 		log.Printf("could not decrypt query: %v", err)
 		return
 	}
 
-	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
-	req, err := gemipfs.ParseRequest(ctx, dq.Request)
+	s.SetReadDeadline(time.Time{})
+
+	var reply *gemipfs.Reply
+	release, err := e.limits.admit(context.Background(), s.Conn().RemotePeer())
 	if err != nil {
-		cncl()
-		log.Printf("could not read request: %v", err)
+		log.Printf("turned away query from %s: %v", s.Conn().RemotePeer(), err)
+		reply = busyReply(err)
+	} else {
+		reply = e.answer(q, dq)
+		release()
+	}
+	if dq.ReplyKey == nil {
+		// older clients only understand a bare attestation.
+		if reply.Attestation == nil {
+			return
+		}
+		if _, err := s.Write(reply.Attestation.Bytes()); err != nil {
+			log.Printf("failed to write attestation: %v", err)
+			return
+		}
+		if _, err := s.Write(reply.Response); err != nil {
+			log.Printf("failed to write response: %v", err)
+		}
 		return
 	}
-	fmt.Printf("going to req %s\n", req.URL)
-	resp, err := req.Do(q.Resource, http.DefaultClient)
+	sealed, err := reply.Seal(dq.ReplyKey, e.padding)
 	if err != nil {
-		cncl()
-		log.Printf("could not fetch request: %v", err)
+		log.Printf("could not seal reply: %v", err)
 		return
 	}
-	cncl()
-	fmt.Printf("finished request for %s\n", req.URL)
-	prf, respBody := a.AttestResponse(resp)
-	// push reponse to repo
-	_, err = http.Post(dq.Repo.String(), "application/octet-stream", bytes.NewReader(respBody))
+	if _, err := s.Write(sealed); err != nil {
+		log.Printf("failed to write reply: %v", err)
+	}
+}
+
+// answer holds the query's exit token while it is answered, and only spends
+// it on an answer; a query that fails can be retried with the same token.
+func (e *exit) answer(q *gemipfs.Query, dq *gemipfs.DecodedQuery) *gemipfs.Reply {
+	if e.tokens == nil {
+		return e.respond(q, dq)
+	}
+	done, err := e.tokens.Reserve(dq.ExitToken)
 	if err != nil {
-		log.Printf("failed to post to repo: %v", err)
-		// failed to write to repo...
-		return
+		log.Printf("query without a valid token: %v", err)
+		return &gemipfs.Reply{Status: gemipfs.ReplyUnauthorized, Message: err.Error()}
 	}
+	reply := e.respond(q, dq)
+	if err := done(reply.Status == gemipfs.ReplyOK); err != nil {
+		log.Printf("could not record spent token: %v", err)
+	}
+	return reply
+}
 
-	// respond with attestation
-	defer s.Close()
-	_, err = s.Write(prf.Bytes())
+func (e *exit) respond(q *gemipfs.Query, dq *gemipfs.DecodedQuery) *gemipfs.Reply {
+	// the client's timeout bounds the fetch.
+	req, err := gemipfs.ParseRequest(context.Background(), dq.Request)
 	if err != nil {
-		log.Printf("failed to write attestation: %v", err)
-		return
+		log.Printf("could not read request: %v", err)
+		return &gemipfs.Reply{Status: gemipfs.ReplyBadRequest, Message: err.Error()}
+	}
+	// private requests are passed through, and their responses only ever
+	// go back to the client that asked.
+	if !req.Public() {
+		reply, _ := e.fetch(q, dq, req, "", false)
+		return reply
+	}
+	key := cacheKey(q, req)
+	if e.cache != nil {
+		if reply := e.cachedAnswer(key, dq); reply != nil {
+			return reply
+		}
+	}
+	// identical queries in flight share one fetch, attestation and upload.
+	// The response is sealed under a key derived from the query, so the one
+	// upload serves each; the replies are still sealed to each client's own
+	// reply key. Each waiter's exit token pays for its answer, but only the
+	// first query's repo tokens are spent storing the response.
+	leader := false
+	v, _, shared := e.inflight.Do(key+repoKey(dq.Repos), func() (interface{}, error) {
+		leader = true
+		reply, shareable := e.fetch(q, dq, req, key, true)
+		return fetched{reply, shareable}, nil
+	})
+	f := v.(fetched)
+	if !leader && !f.shareable {
+		// the response was only for the query that made it.
+		reply, _ := e.fetch(q, dq, req, "", false)
+		return reply
+	}
+	if shared {
+		log.Printf("coalesced query for %s", req.URL)
+	}
+	return f.reply
+}
+
+// fetched is the answer to a fetch, and whether it can be given to others
+// making the same query.
+type fetched struct {
+	reply     *gemipfs.Reply
+	shareable bool
+}
+
+func repoKey(locs []gemipfs.Location) string {
+	key := ""
+	for _, l := range locs {
+		key += "\n" + l.String()
+	}
+	return key
+}
+
+// fetch answers a query from the origin. Public answers are cached under
+// key and stored where the client asks; private ones, and those setting
+// cookies, are delivered directly and can't be shared.
+func (e *exit) fetch(q *gemipfs.Query, dq *gemipfs.DecodedQuery, req *gemipfs.Request, key string, public bool) (*gemipfs.Reply, bool) {
+	fmt.Printf("going to req %s\n", req.URL)
+	if err := e.limits.waitDomain(context.Background(), req.URL.Hostname()); err != nil {
+		log.Printf("not fetching %s: %v", req.URL, err)
+		return busyReply(err), true
+	}
+	resp, err := req.Do(q.Resource, e.client)
+	if errors.Is(err, errEgressDenied) {
+		log.Printf("refused request: %v", err)
+		return &gemipfs.Reply{Status: gemipfs.ReplyForbidden, Message: err.Error()}, true
+	} else if err != nil {
+		log.Printf("could not fetch request: %v", err)
+		return &gemipfs.Reply{Status: gemipfs.ReplyFetchFailed, Message: err.Error()}, true
+	}
+	fmt.Printf("finished request for %s\n", req.URL)
+	resp.Padding = e.padding
+	prf, respBody := e.attester.AttestResponse(resp)
+	if public && resp.SetsCookies() {
+		log.Printf("not sharing %s, which sets cookies", req.URL)
+		public = false
+	}
+	if !public {
+		return &gemipfs.Reply{Status: gemipfs.ReplyOK, Attestation: prf, Response: respBody}, false
+	}
+	remember := func() {
+		if e.cache != nil {
+			e.cache.add(key, resp, prf, respBody)
+		}
+	}
+	if len(dq.Repos) == 0 {
+		// no repo - deliver the response directly.
+		remember()
+		return &gemipfs.Reply{Status: gemipfs.ReplyOK, Attestation: prf, Response: respBody}, true
+	}
+	if e.prefetchPolicy.max > 0 {
+		if reply := e.answerWithBundle(req, resp, prf, respBody, dq); reply != nil {
+			remember()
+			return reply, true
+		}
+	}
+	// push reponse to repo
+	prf.Locations, err = e.storeResponse(dq.Repos, prf.Resp, respBody, dq.RepoTokens)
+	if err != nil {
+		log.Printf("failed to post to repo: %v", err)
+		return &gemipfs.Reply{Status: gemipfs.ReplyStoreFailed, Message: err.Error()}, true
 	}
+	remember()
+	return &gemipfs.Reply{Status: gemipfs.ReplyOK, Attestation: prf}, true
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+	"golang.org/x/net/html"
+)
+
+const (
+	prefetchWorkers = 4
+	prefetchTimeout = 10 * time.Second
+)
+
+// kinds of subresource that can be prefetched.
+const (
+	kindStyle  = "style"
+	kindScript = "script"
+	kindImage  = "image"
+	kindFont   = "font"
+)
+
+// prefetchPolicy bounds the subresources an exit fetches along with a page.
+type prefetchPolicy struct {
+	// max is the number of subresources to fetch per page; 0 disables
+	// prefetching.
+	max         int
+	kinds       map[string]bool
+	crossOrigin bool
+	maxBytes    int
+}
+
+func parsePrefetchKinds(s string) (map[string]bool, error) {
+	kinds := make(map[string]bool)
+	for _, k := range strings.Split(s, ",") {
+		switch k = strings.TrimSpace(k); k {
+		case kindStyle, kindScript, kindImage, kindFont:
+			kinds[k] = true
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown subresource kind: %s", k)
+		}
+	}
+	return kinds, nil
+}
+
+type subresource struct {
+	url  *url.URL
+	kind string
+}
+
+// prefetch fetches the subresources of a page allowed by the policy,
+// returning their attested responses. Stylesheets are followed one level,
+// for the fonts and images they use.
+func (e *exit) prefetch(page *gemipfs.Request, resp *gemipfs.Response) []gemipfs.BundleEntry {
+	hr, err := resp.HTTP(page.Request)
+	if err != nil {
+		return nil
+	}
+	defer hr.Body.Close()
+	// links are relative to where the page ended up, after any redirects.
+	base, err := resp.URL()
+	if err != nil {
+		return nil
+	}
+	refs := e.subresources(base, hr)
+	if len(refs) == 0 {
+		return nil
+	}
+
+	ctx, cncl := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cncl()
+	seen := map[string]bool{page.URL.String(): true}
+	var entries []gemipfs.BundleEntry
+	for depth := 0; depth < 2 && len(refs) > 0 && len(entries) < e.prefetchPolicy.max; depth++ {
+		var todo []subresource
+		for _, r := range refs {
+			if seen[r.url.String()] || len(entries)+len(todo) >= e.prefetchPolicy.max {
+				continue
+			}
+			seen[r.url.String()] = true
+			todo = append(todo, r)
+		}
+		fetched, next := e.fetchSubresources(ctx, todo)
+		entries = append(entries, fetched...)
+		refs = next
+	}
+	log.Printf("prefetched %d subresources of %s\n", len(entries), page.URL)
+	return entries
+}
+
+// fetchSubresources fetches a batch of subresources in parallel, returning
+// them along with the references found in any stylesheets.
+func (e *exit) fetchSubresources(ctx context.Context, todo []subresource) ([]gemipfs.BundleEntry, []subresource) {
+	var mtx sync.Mutex
+	var entries []gemipfs.BundleEntry
+	var next []subresource
+
+	work := make(chan subresource)
+	var wg sync.WaitGroup
+	for i := 0; i < prefetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sr := range work {
+				entry, refs, err := e.fetchSubresource(ctx, sr)
+				if err != nil {
+					log.Printf("could not prefetch %s: %v\n", sr.url, err)
+					continue
+				}
+				mtx.Lock()
+				entries = append(entries, *entry)
+				next = append(next, refs...)
+				mtx.Unlock()
+			}
+		}()
+	}
+	for _, sr := range todo {
+		work <- sr
+	}
+	close(work)
+	wg.Wait()
+	return entries, next
+}
+
+func (e *exit) fetchSubresource(ctx context.Context, sr subresource) (*gemipfs.BundleEntry, []subresource, error) {
+	if err := e.limits.waitDomain(ctx, sr.url.Hostname()); err != nil {
+		return nil, nil, err
+	}
+	hr, err := http.NewRequestWithContext(ctx, http.MethodGet, sr.url.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := gemipfs.Wrap(hr)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := req.Do(req.RequestCID(), e.client)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.SetsCookies() {
+		return nil, nil, errors.New("response sets cookies")
+	}
+	if e.prefetchPolicy.maxBytes > 0 && len(resp.Transcript) > e.prefetchPolicy.maxBytes {
+		return nil, nil, fmt.Errorf("response is %d bytes", len(resp.Transcript))
+	}
+	rhr, err := resp.HTTP(hr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rhr.Body.Close()
+	if rhr.StatusCode < 200 || rhr.StatusCode >= 300 {
+		return nil, nil, fmt.Errorf("origin responded %s", rhr.Status)
+	}
+	var refs []subresource
+	if sr.kind == kindStyle {
+		base, err := resp.URL()
+		if err != nil {
+			return nil, nil, err
+		}
+		refs = e.subresources(base, rhr)
+	}
+
+	resp.Padding = e.padding
+	prf, body := e.attester.AttestResponse(resp)
+	return &gemipfs.BundleEntry{Attestation: prf, Body: body}, refs, nil
+}
+
+// subresources lists the references in an HTML page or stylesheet that the
+// policy allows.
+func (e *exit) subresources(base *url.URL, hr *http.Response) []subresource {
+	mt, _, _ := mime.ParseMediaType(hr.Header.Get("Content-Type"))
+	var refs []subresource
+	switch mt {
+	case "text/html":
+		refs = htmlSubresources(base, hr.Body)
+	case "text/css":
+		b, err := io.ReadAll(io.LimitReader(hr.Body, int64(gemipfs.MaxBlockSize)))
+		if err != nil {
+			return nil
+		}
+		refs = cssSubresources(base, string(b))
+	}
+	allowed := refs[:0]
+	for _, r := range refs {
+		if !e.prefetchPolicy.kinds[r.kind] {
+			continue
+		}
+		if r.url.Scheme != "http" && r.url.Scheme != "https" {
+			continue
+		}
+		if !e.prefetchPolicy.crossOrigin && (r.url.Scheme != base.Scheme || r.url.Host != base.Host) {
+			continue
+		}
+		r.url.Fragment = ""
+		allowed = append(allowed, r)
+	}
+	return allowed
+}
+
+func htmlSubresources(base *url.URL, r io.Reader) []subresource {
+	var refs []subresource
+	add := func(ref string, kind string) {
+		if u, err := base.Parse(strings.TrimSpace(ref)); err == nil && ref != "" {
+			refs = append(refs, subresource{u, kind})
+		}
+	}
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return refs
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			attrs := make(map[string]string, len(t.Attr))
+			for _, a := range t.Attr {
+				attrs[a.Key] = a.Val
+			}
+			switch t.Data {
+			case "base":
+				if u, err := base.Parse(attrs["href"]); err == nil && attrs["href"] != "" {
+					base = u
+				}
+			case "link":
+				rels := strings.Fields(strings.ToLower(attrs["rel"]))
+				for _, rel := range rels {
+					switch rel {
+					case "stylesheet":
+						add(attrs["href"], kindStyle)
+					case "icon":
+						add(attrs["href"], kindImage)
+					case "preload", "modulepreload":
+						if kind := preloadKind(attrs["as"], rel); kind != "" {
+							add(attrs["href"], kind)
+						}
+					}
+				}
+			case "script":
+				add(attrs["src"], kindScript)
+			case "img", "source":
+				add(attrs["src"], kindImage)
+				for _, candidate := range strings.Split(attrs["srcset"], ",") {
+					if f := strings.Fields(candidate); len(f) > 0 {
+						add(f[0], kindImage)
+					}
+				}
+			case "style":
+				if z.Next() == html.TextToken {
+					refs = append(refs, cssSubresources(base, string(z.Text()))...)
+				}
+			}
+		}
+	}
+}
+
+func preloadKind(as string, rel string) string {
+	if rel == "modulepreload" {
+		return kindScript
+	}
+	switch as {
+	case "style":
+		return kindStyle
+	case "script":
+		return kindScript
+	case "image":
+		return kindImage
+	case "font":
+		return kindFont
+	}
+	return ""
+}
+
+var (
+	cssURL    = regexp.MustCompile(`url\(\s*['"]?([^'")]+?)['"]?\s*\)`)
+	cssImport = regexp.MustCompile(`@import\s+['"]([^'"]+)['"]`)
+)
+
+func cssSubresources(base *url.URL, css string) []subresource {
+	var refs []subresource
+	for _, m := range cssImport.FindAllStringSubmatch(css, -1) {
+		if u, err := base.Parse(m[1]); err == nil {
+			refs = append(refs, subresource{u, kindStyle})
+		}
+	}
+	for _, m := range cssURL.FindAllStringSubmatch(css, -1) {
+		if strings.HasPrefix(m[1], "data:") {
+			continue
+		}
+		u, err := base.Parse(m[1])
+		if err != nil {
+			continue
+		}
+		kind := kindImage
+		switch strings.ToLower(path.Ext(u.Path)) {
+		case ".woff", ".woff2", ".ttf", ".otf", ".eot":
+			kind = kindFont
+		case ".css":
+			kind = kindStyle
+		}
+		refs = append(refs, subresource{u, kind})
+	}
+	return refs
+}
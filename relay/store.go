@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+const (
+	storeAttempts = 3
+	storeBackoff  = 250 * time.Millisecond
+	storeTimeout  = 30 * time.Second
+	// maxCidSize bounds a repo's answer to a store, which is a cid.
+	maxCidSize = 256
+)
+
+// storeResponse pushes the response to the first of the locations that
+// accepts it, retrying each location with exponential backoff before
+// falling back to the next. It returns the locations now holding the
+// response. The tokens, if any, are passed on to the repo at the same
+// index. Repos must store the response as want.
+func (e *exit) storeResponse(locs []gemipfs.Location, want cid.Cid, body []byte, tokens [][]byte) ([]gemipfs.Location, error) {
+	return e.store(locs, "application/octet-stream", want, body, tokens)
+}
+
+// storeBundle pushes a car of a page bundle with root want, in the same way
+// as storeResponse.
+func (e *exit) storeBundle(locs []gemipfs.Location, want cid.Cid, car []byte, tokens [][]byte) ([]gemipfs.Location, error) {
+	return e.store(locs, gemipfs.CarContentType, want, car, tokens)
+}
+
+func (e *exit) store(locs []gemipfs.Location, contentType string, want cid.Cid, body []byte, tokens [][]byte) ([]gemipfs.Location, error) {
+	ctx, cncl := context.WithTimeout(context.Background(), storeTimeout)
+	defer cncl()
+
+	var errs []error
+	for i, l := range locs {
+		var token []byte
+		if i < len(tokens) {
+			token = tokens[i]
+		}
+		err := retry(ctx, func() error { return e.storeAt(ctx, l, contentType, want, body, token) })
+		if err == nil {
+			return []gemipfs.Location{l}, nil
+		}
+		log.Printf("failed to store at %s: %v", l, err)
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func retry(ctx context.Context, f func() error) error {
+	backoff := storeBackoff
+	var err error
+	for i := 0; i < storeAttempts; i++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		if errors.Is(err, gemipfs.ErrRepoUnauthorized) {
+			// the token won't be any better next time.
+			break
+		}
+		if i == storeAttempts-1 {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func (e *exit) storeAt(ctx context.Context, l gemipfs.Location, contentType string, want cid.Cid, body []byte, token []byte) error {
+	var got cid.Cid
+	if l.IsLibP2P() {
+		ai, err := l.AddrInfo()
+		if err != nil {
+			return err
+		}
+		put := gemipfs.PutToRepo
+		if contentType == gemipfs.CarContentType {
+			put = gemipfs.PutCarToRepo
+		}
+		if got, err = put(ctx, e.host, *ai, body, token); err != nil {
+			return err
+		}
+		return checkStored(want, got)
+	}
+	u, err := l.URL()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", gemipfs.AuthorizationHeader(token))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%w: repo responded %s", gemipfs.ErrRepoUnauthorized, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("repo responded %s", resp.Status)
+	}
+	cb, err := io.ReadAll(io.LimitReader(resp.Body, maxCidSize))
+	if err != nil {
+		return err
+	}
+	if _, got, err = cid.CidFromBytes(cb); err != nil {
+		return err
+	}
+	return checkStored(want, got)
+}
+
+// checkStored checks that a repo stored what was sent, rather than, say, a
+// cut off or re-encoded copy that would be found under another cid.
+func checkStored(want, got cid.Cid) error {
+	if !got.Equals(want) {
+		return fmt.Errorf("repo stored %s, not %s", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+// fetchResponse retrieves an encrypted response from the first of the
+// locations that has it.
+func fetchResponse(ctx context.Context, h host.Host, locs []gemipfs.Location, c cid.Cid) ([]byte, error) {
+	if len(locs) == 0 {
+		return nil, errors.New("no repo locations for response")
+	}
+	var errs []error
+	for _, l := range locs {
+		b, err := fetchFrom(ctx, h, l, c)
+		if err == nil {
+			return b, nil
+		}
+		log.Printf("could not get response from %s: %v\n", l, err)
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func fetchFrom(ctx context.Context, h host.Host, l gemipfs.Location, c cid.Cid) ([]byte, error) {
+	if l.IsLibP2P() {
+		ai, err := l.AddrInfo()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("resp is at %s\n", l)
+		return gemipfs.GetFromRepo(ctx, h, *ai, c)
+	}
+	u, err := l.URL()
+	if err != nil {
+		return nil, err
+	}
+	u = u.JoinPath("ipfs", c.String())
+	u.RawQuery = "format=raw"
+	log.Printf("resp is at %s\n", u)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("repo responded %s", resp.Status)
+	}
+	b, err := gemipfs.ReadBlock(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := gemipfs.CheckBlock(c, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/multiformats/go-multicodec"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+// The repo serves stored blocks following the IPFS trustless gateway spec,
+// https://specs.ipfs.tech/http-gateways/trustless-gateway/
+const (
+	rawContentType = "application/vnd.ipld.raw"
+	carContentType = "application/vnd.ipld.car"
+	// the car responses we produce.
+	carResponseType = carContentType + "; version=1; order=dfs; dups=n"
+
+	immutableCacheControl = "public, max-age=29030400, immutable"
+)
+
+func (repo *Repo) gateway(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cidStr, subPath, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/ipfs/"), "/")
+	c, err := cid.Parse(cidStr)
+	if err != nil {
+		http.Error(w, "could not parse cid", http.StatusBadRequest)
+		return
+	}
+	format, err := responseFormat(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// stored responses are opaque blocks, and bundles only link to them, so
+	// there are no paths to traverse.
+	if subPath != "" {
+		http.Error(w, "path traversal is not supported", http.StatusBadRequest)
+		return
+	}
+
+	blk, err := repo.bs.Get(req.Context(), c)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("gateway %s %s as %s (%d bytes)\n", req.Method, c, format, len(blk.RawData()))
+
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Ipfs-Path", req.URL.Path)
+	w.Header().Add("Vary", "Accept")
+
+	switch format {
+	case rawContentType:
+		w.Header().Set("Content-Type", rawContentType)
+		w.Header().Set("Etag", fmt.Sprintf(`"%s.raw"`, c))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.bin"`, c))
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(blk.RawData()))
+	case carContentType:
+		scope := req.URL.Query().Get("dag-scope")
+		switch scope {
+		case "":
+			scope = "all"
+		case "block", "entity", "all":
+		default:
+			http.Error(w, "invalid dag-scope", http.StatusBadRequest)
+			return
+		}
+		buf := bytes.NewBuffer(nil)
+		cw, err := storage.NewWritable(buf, []cid.Cid{c}, car.WriteAsCarV1(true))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := repo.writeDag(req.Context(), cw, blk, scope == "all", map[cid.Cid]struct{}{}); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", carResponseType)
+		w.Header().Set("Etag", fmt.Sprintf(`"%s.car.%s"`, c, scope))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.car"`, c))
+		w.Header().Set("Accept-Ranges", "none")
+		if match := req.Header.Get("If-None-Match"); match != "" && match == w.Header().Get("Etag") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(buf.Len()))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(buf.Bytes())
+		}
+	}
+}
+
+// writeDag adds a block to the car, along with the blocks it links to when
+// following links. Stored responses are opaque blocks, but bundles link to
+// the responses they carry from a dag-json index.
+func (repo *Repo) writeDag(ctx context.Context, cw storage.WritableCar, blk blocks.Block, follow bool, seen map[cid.Cid]struct{}) error {
+	if _, ok := seen[blk.Cid()]; ok {
+		return nil
+	}
+	seen[blk.Cid()] = struct{}{}
+	if err := cw.Put(ctx, blk.Cid().KeyString(), blk.RawData()); err != nil {
+		return err
+	}
+	if !follow || blk.Cid().Prefix().Codec != uint64(multicodec.DagJson) {
+		return nil
+	}
+	links, err := gemipfs.DagJSONLinks(blk.RawData())
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		child, err := repo.bs.Get(ctx, l)
+		if err != nil {
+			return fmt.Errorf("missing linked block %s: %w", l, err)
+		}
+		if err := repo.writeDag(ctx, cw, child, follow, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// responseFormat picks between raw blocks and cars from the format query
+// parameter, which takes precedence, or the Accept header.
+func responseFormat(req *http.Request) (string, error) {
+	switch req.URL.Query().Get("format") {
+	case "raw":
+		return rawContentType, nil
+	case "car":
+		return carContentType, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported format: %s", req.URL.Query().Get("format"))
+	}
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case rawContentType:
+			return rawContentType, nil
+		case carContentType:
+			if v, ok := params["version"]; ok && v != "1" {
+				continue
+			}
+			return carContentType, nil
+		}
+	}
+	return "", fmt.Errorf("a format of raw or car must be requested")
+}
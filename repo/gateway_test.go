@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+func newTestBlockstore(t *testing.T) *blockstore.ReadWrite {
+	t.Helper()
+	bs, err := blockstore.OpenReadWrite(filepath.Join(t.TempDir(), "repo.car"), []cid.Cid{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bs.Close() })
+	return bs
+}
+
+func putBlock(t *testing.T, bs *blockstore.ReadWrite, codec multicodec.Code, b []byte) cid.Cid {
+	t.Helper()
+	c, err := cid.V1Builder{Codec: uint64(codec), MhType: multihash.SHA2_256, MhLength: -1}.Sum(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := blocks.NewBlockWithCid(b, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Put(context.Background(), blk); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTestGateway serves a repo holding a response and a bundle index
+// linking to it.
+func newTestGateway(t *testing.T) (srv *httptest.Server, resp, bundle cid.Cid) {
+	t.Helper()
+	bs := newTestBlockstore(t)
+	resp = putBlock(t, bs, multicodec.Raw, []byte("a sealed response"))
+	bundle = putBlock(t, bs, multicodec.DagJson, []byte(fmt.Sprintf(`{"entries":[{"response":{"/":"%s"}}]}`, resp)))
+
+	repo := &Repo{bs: bs}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ipfs/", repo.gateway)
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, resp, bundle
+}
+
+func fetch(t *testing.T, method, u string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func carBlocks(t *testing.T, b []byte) (roots, cids []cid.Cid) {
+	t.Helper()
+	br, err := car.NewBlockReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			return br.Roots, cids
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		cids = append(cids, blk.Cid())
+	}
+}
+
+func TestGatewayRaw(t *testing.T) {
+	srv, c, _ := newTestGateway(t)
+	u := srv.URL + "/ipfs/" + c.String()
+	raw := http.Header{"Accept": {rawContentType}}
+
+	resp, body := fetch(t, http.MethodGet, u, raw)
+	if resp.StatusCode != http.StatusOK || string(body) != "a sealed response" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != rawContentType {
+		t.Fatalf("content type %s, want %s", ct, rawContentType)
+	}
+	etag := resp.Header.Get("Etag")
+	if etag != fmt.Sprintf(`"%s.raw"`, c) {
+		t.Fatalf("etag %s", etag)
+	}
+
+	// the format parameter asks for the same response.
+	if resp, body := fetch(t, http.MethodGet, u+"?format=raw", nil); resp.StatusCode != http.StatusOK || string(body) != "a sealed response" {
+		t.Fatalf("format=raw got %d %q", resp.StatusCode, body)
+	}
+
+	resp, body = fetch(t, http.MethodGet, u, http.Header{"Accept": {rawContentType}, "Range": {"bytes=2-7"}})
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "sealed" {
+		t.Fatalf("range got %d %q", resp.StatusCode, body)
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != "bytes 2-7/17" {
+		t.Fatalf("content range %s", cr)
+	}
+
+	resp, body = fetch(t, http.MethodHead, u, raw)
+	if resp.StatusCode != http.StatusOK || len(body) != 0 || resp.ContentLength != 17 {
+		t.Fatalf("head got %d, %d bytes, length %d", resp.StatusCode, len(body), resp.ContentLength)
+	}
+
+	resp, _ = fetch(t, http.MethodGet, u, http.Header{"Accept": {rawContentType}, "If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("revalidation got %d", resp.StatusCode)
+	}
+}
+
+func TestGatewayCar(t *testing.T) {
+	srv, resp, bundle := newTestGateway(t)
+	u := srv.URL + "/ipfs/" + bundle.String() + "?format=car"
+
+	for _, tc := range []struct {
+		scope string
+		want  []cid.Cid
+		etag  string
+	}{
+		{"", []cid.Cid{bundle, resp}, "all"},
+		{"all", []cid.Cid{bundle, resp}, "all"},
+		{"entity", []cid.Cid{bundle}, "entity"},
+		{"block", []cid.Cid{bundle}, "block"},
+	} {
+		t.Run("scope "+tc.scope, func(t *testing.T) {
+			su := u
+			if tc.scope != "" {
+				su += "&dag-scope=" + tc.scope
+			}
+			r, body := fetch(t, http.MethodGet, su, nil)
+			if r.StatusCode != http.StatusOK {
+				t.Fatalf("got %d: %s", r.StatusCode, body)
+			}
+			if ct := r.Header.Get("Content-Type"); ct != carResponseType {
+				t.Fatalf("content type %s, want %s", ct, carResponseType)
+			}
+			roots, got := carBlocks(t, body)
+			if len(roots) != 1 || !roots[0].Equals(bundle) {
+				t.Fatalf("roots %v, want %s", roots, bundle)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("blocks %v, want %v", got, tc.want)
+			}
+			etag := r.Header.Get("Etag")
+			if etag != fmt.Sprintf(`"%s.car.%s"`, bundle, tc.etag) {
+				t.Fatalf("etag %s", etag)
+			}
+
+			head, hb := fetch(t, http.MethodHead, su, nil)
+			if head.StatusCode != http.StatusOK || len(hb) != 0 || head.ContentLength != int64(len(body)) {
+				t.Fatalf("head got %d, %d bytes, length %d", head.StatusCode, len(hb), head.ContentLength)
+			}
+			if re, _ := fetch(t, http.MethodGet, su, http.Header{"If-None-Match": {etag}}); re.StatusCode != http.StatusNotModified {
+				t.Fatalf("revalidation got %d", re.StatusCode)
+			}
+		})
+	}
+
+	// cars are built for each request, so can't be served in ranges.
+	r, body := fetch(t, http.MethodGet, u, http.Header{"Range": {"bytes=0-9"}})
+	if r.StatusCode != http.StatusOK || r.Header.Get("Accept-Ranges") != "none" {
+		t.Fatalf("range got %d, accept-ranges %q", r.StatusCode, r.Header.Get("Accept-Ranges"))
+	}
+	if _, got := carBlocks(t, body); len(got) != 2 {
+		t.Fatalf("range got %d blocks, want the whole car", len(got))
+	}
+}
+
+func TestGatewayRejects(t *testing.T) {
+	srv, resp, bundle := newTestGateway(t)
+	missing, err := cid.V1Builder{Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte("never stored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+		status int
+	}{
+		{"raw sub-path", http.MethodGet, "/ipfs/" + resp.String() + "/a?format=raw", nil, http.StatusBadRequest},
+		{"car sub-path", http.MethodGet, "/ipfs/" + bundle.String() + "/entries/0?format=car", nil, http.StatusBadRequest},
+		{"bad dag-scope", http.MethodGet, "/ipfs/" + bundle.String() + "?format=car&dag-scope=some", nil, http.StatusBadRequest},
+		{"bad format", http.MethodGet, "/ipfs/" + resp.String() + "?format=tar", nil, http.StatusBadRequest},
+		{"no format", http.MethodGet, "/ipfs/" + resp.String(), http.Header{"Accept": {"text/html"}}, http.StatusBadRequest},
+		{"car version 2", http.MethodGet, "/ipfs/" + resp.String(), http.Header{"Accept": {carContentType + "; version=2"}}, http.StatusBadRequest},
+		{"bad cid", http.MethodGet, "/ipfs/nope?format=raw", nil, http.StatusBadRequest},
+		{"missing", http.MethodGet, "/ipfs/" + missing.String() + "?format=raw", nil, http.StatusNotFound},
+		{"post", http.MethodPost, "/ipfs/" + resp.String() + "?format=raw", nil, http.StatusMethodNotAllowed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, body := fetch(t, tc.method, srv.URL+tc.path, tc.header)
+			if r.StatusCode != tc.status {
+				t.Fatalf("got %d (%s), want %d", r.StatusCode, bytes.TrimSpace(body), tc.status)
+			}
+		})
+	}
+}
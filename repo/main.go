@@ -1,28 +1,46 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"strings"
 	"time"
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
 )
 
 type Repo struct {
 	bs *blockstore.ReadWrite
+	// tokens, when set, must be redeemed to store responses.
+	tokens *gemipfs.TokenVerifier
 }
 
 func main() {
 	storeLoc := flag.String("store", "tmp.car", "direct blockstore car")
 	pubAddr := flag.String("pubaddr", ":8080", "public listen address")
 	adminAddr := flag.String("adminaddr", ":8081", "admin listen address")
+	p2pAddr := flag.String("p2paddr", ":8084", "libp2p listen address")
+	identity := flag.String("identity", "repo.key", "libp2p identity of the repo (created if missing)")
+	tokenKeyLoc := flag.String("tokenkey", "token.pem", "privacy pass issuer key (created if missing)")
+	requireToken := flag.Bool("requiretoken", false, "require a privacy pass token to store responses")
+	spent := flag.String("spent", "repo.spent", "where redeemed privacy pass tokens are recorded")
+	origins := flag.String("origin", "", "comma separated hosts (with any port) clients reach this repo at over http, which tokens are bound to")
+	credentials := flag.String("issuer-credentials", "", "file of credentials, one per line, that clients show to be issued tokens (none are issued without)")
+	issueRate := flag.Float64("issuer-rate", 100, "tokens issued an hour for each credential")
 	flag.Parse()
 
 	bsrw, err := blockstore.OpenReadWrite(*storeLoc, []cid.Cid{})
@@ -32,12 +50,51 @@ func main() {
 	}
 	defer bsrw.Close()
 
+	issuer, err := getOrSetIssuer(*tokenKeyLoc)
+	if err != nil {
+		fmt.Printf("couldn't load token issuer: %v\n", err)
+		return
+	}
+
+	if *credentials != "" {
+		if issuer.Attester, err = gemipfs.LoadCredentialAttester(*credentials, *issueRate); err != nil {
+			fmt.Printf("couldn't load issuer credentials: %v\n", err)
+			return
+		}
+	}
+
 	R := Repo{
-		bsrw,
+		bs: bsrw,
+	}
+	if *requireToken {
+		// tokens are bound to the repo's peer ID, and to the hosts it is
+		// reached at over http.
+		sk, err := gemipfs.LoadOrCreateIdentity(*identity)
+		if err != nil {
+			fmt.Printf("couldn't load identity: %v\n", err)
+			return
+		}
+		id, err := peer.IDFromPrivateKey(sk)
+		if err != nil {
+			fmt.Printf("couldn't load identity: %v\n", err)
+			return
+		}
+		challenges := []gemipfs.TokenChallenge{gemipfs.TokenChallengeFor(id.String())}
+		for _, o := range strings.Split(*origins, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				challenges = append(challenges, gemipfs.TokenChallengeFor(o))
+			}
+		}
+		R.tokens, err = gemipfs.NewTokenVerifier(issuer.TokenKey(), *spent, challenges...)
+		if err != nil {
+			fmt.Printf("couldn't load token verifier: %v\n", err)
+			return
+		}
 	}
 
 	pubHandler := http.NewServeMux()
 	pubHandler.HandleFunc("/", R.repo)
+	pubHandler.HandleFunc("/ipfs/", R.gateway)
 	pubS := &http.Server{
 		Addr:           *pubAddr,
 		Handler:        pubHandler,
@@ -47,7 +104,8 @@ func main() {
 	}
 
 	adminHandler := http.NewServeMux()
-	adminHandler.HandleFunc("/", issueToken)
+	adminHandler.HandleFunc(gemipfs.TokenDirectoryPath, issuer.ServeDirectory)
+	adminHandler.HandleFunc(gemipfs.TokenRequestPath, issuer.ServeTokenRequest)
 	adminS := &http.Server{
 		Addr:           *adminAddr,
 		Handler:        adminHandler,
@@ -55,6 +113,16 @@ func main() {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
+	host, err := R.listenLibP2P(*p2pAddr, *identity)
+	if err != nil {
+		fmt.Printf("couldn't start libp2p host: %v\n", err)
+		return
+	}
+	defer host.Close()
+	for _, a := range host.Addrs() {
+		log.Printf("libp2p repo at %s/p2p/%s\n", a, host.ID())
+	}
+
 	go func() {
 		pubS.ListenAndServe()
 	}()
@@ -83,28 +151,102 @@ func (repo *Repo) repo(r http.ResponseWriter, req *http.Request) {
 		r.WriteHeader(200)
 		r.Write(blk.RawData())
 	} else if req.Method == "POST" {
-		blkb, err := io.ReadAll(req.Body)
-		if err != nil {
-			r.WriteHeader(406)
-			return
+		// the token is only spent once the response is stored, so it can be
+		// tried again if storing fails.
+		spend := func(bool) error { return nil }
+		if repo.tokens != nil {
+			done, ok := repo.tokens.ReserveHTTP(r, req)
+			if !ok {
+				return
+			}
+			spend = done
 		}
-		v1b := cid.V1Builder{
-			Codec:    uint64(multicodec.Https),
-			MhType:   multihash.SHA2_256,
-			MhLength: -1,
+		c, status := repo.post(req)
+		if err := spend(status == http.StatusOK); err != nil {
+			log.Printf("could not record spent token: %v\n", err)
 		}
-		c1, _ := v1b.Sum(blkb)
-		blk, _ := blocks.NewBlockWithCid(blkb, c1)
-		repo.bs.Put(req.Context(), blk)
-		r.WriteHeader(200)
-		log.Printf("post %s\n", blk.Cid().String())
-		r.Write(blk.Cid().Bytes())
+		r.WriteHeader(status)
+		if status != http.StatusOK {
+			return
+		}
+		log.Printf("post %s\n", c.String())
+		r.Write(c.Bytes())
 	} else {
 		r.WriteHeader(406)
 		return
 	}
 }
 
-func issueToken(r http.ResponseWriter, req *http.Request) {
-	//TODO: privacy pass issuance/redemption
+// post stores the block or car in the body of a request, returning its cid
+// and the status to respond with.
+func (repo *Repo) post(req *http.Request) (cid.Cid, int) {
+	blkb, err := gemipfs.ReadBlock(req.Body)
+	if errors.Is(err, gemipfs.ErrBlockTooLarge) {
+		return cid.Undef, http.StatusRequestEntityTooLarge
+	} else if err != nil {
+		return cid.Undef, 406
+	}
+	put := repo.put
+	if ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); ct == gemipfs.CarContentType {
+		put = repo.putCar
+	}
+	c, err := put(req.Context(), blkb)
+	if err != nil {
+		return cid.Undef, 500
+	}
+	return c, http.StatusOK
+}
+
+func (repo *Repo) put(ctx context.Context, blkb []byte) (cid.Cid, error) {
+	v1b := cid.V1Builder{
+		Codec:    uint64(multicodec.Https),
+		MhType:   multihash.SHA2_256,
+		MhLength: -1,
+	}
+	c1, err := v1b.Sum(blkb)
+	if err != nil {
+		return cid.Undef, err
+	}
+	blk, err := blocks.NewBlockWithCid(blkb, c1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := repo.bs.Put(ctx, blk); err != nil {
+		return cid.Undef, err
+	}
+	return c1, nil
+}
+
+// putCar stores every block of a car, such as a page bundle, returning its
+// root.
+func (repo *Repo) putCar(ctx context.Context, carb []byte) (cid.Cid, error) {
+	br, err := car.NewBlockReader(bytes.NewReader(carb))
+	if err != nil {
+		return cid.Undef, err
+	}
+	if len(br.Roots) != 1 {
+		return cid.Undef, fmt.Errorf("car has %d roots", len(br.Roots))
+	}
+	var blks []blocks.Block
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return cid.Undef, err
+		}
+		// blocks are served as named, so check they are what they claim.
+		c, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			return cid.Undef, err
+		}
+		if !c.Equals(blk.Cid()) {
+			return cid.Undef, fmt.Errorf("block %s does not match its cid", blk.Cid())
+		}
+		blks = append(blks, blk)
+	}
+	if err := repo.bs.PutMany(ctx, blks); err != nil {
+		return cid.Undef, err
+	}
+	return br.Roots[0], nil
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	manet "github.com/multiformats/go-multiaddr/net"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+const (
+	p2pTimeout = 10 * time.Second
+	// tokens are a few hundred bytes; anything larger is not one.
+	maxTokenSize = 4096
+)
+
+func (repo *Repo) listenLibP2P(addr string, identity string) (host.Host, error) {
+	sk, err := gemipfs.LoadOrCreateIdentity(identity)
+	if err != nil {
+		return nil, err
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ma, err := manet.FromNetAddr(tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	h, err := libp2p.New(libp2p.ListenAddrs(ma), libp2p.Identity(sk))
+	if err != nil {
+		return nil, err
+	}
+	handoffs, err := gemipfs.LoadHandoffs(identity)
+	if err != nil {
+		return nil, err
+	}
+	if err := gemipfs.ServeHandoffs(h, handoffs); err != nil {
+		return nil, err
+	}
+	repo.serveLibP2P(h)
+	return h, nil
+}
+
+func (repo *Repo) serveLibP2P(h host.Host) {
+	h.SetStreamHandler(gemipfs.RepoPutProtocol, repo.p2pPut)
+	h.SetStreamHandler(gemipfs.RepoPutCarProtocol, repo.p2pPutCar)
+	h.SetStreamHandler(gemipfs.RepoGetProtocol, repo.p2pGet)
+}
+
+func (repo *Repo) p2pPut(s network.Stream) {
+	repo.p2pPutWith(s, repo.put)
+}
+
+func (repo *Repo) p2pPutCar(s network.Stream) {
+	repo.p2pPutWith(s, repo.putCar)
+}
+
+func (repo *Repo) p2pPutWith(s network.Stream, put func(context.Context, []byte) (cid.Cid, error)) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(p2pTimeout))
+	r := bufio.NewReader(s)
+	tl, err := binary.ReadUvarint(r)
+	if err != nil || tl > maxTokenSize {
+		s.Reset()
+		return
+	}
+	token := make([]byte, tl)
+	if _, err := io.ReadFull(r, token); err != nil {
+		s.Reset()
+		return
+	}
+	// the token is only spent once the response is stored, so it can be
+	// tried again if storing fails.
+	stored := false
+	if repo.tokens != nil {
+		done, err := repo.tokens.Reserve(token)
+		if err != nil {
+			writeStatus(s, gemipfs.RepoUnauthorized, []byte(err.Error()))
+			return
+		}
+		defer func() {
+			if err := done(stored); err != nil {
+				log.Printf("could not record spent token: %v\n", err)
+			}
+		}()
+	}
+	body, err := gemipfs.ReadBlock(r)
+	if errors.Is(err, gemipfs.ErrBlockTooLarge) {
+		writeStatus(s, gemipfs.RepoError, []byte(err.Error()))
+		return
+	} else if err != nil {
+		s.Reset()
+		return
+	}
+	ctx, cncl := context.WithTimeout(context.Background(), p2pTimeout)
+	defer cncl()
+	c, err := put(ctx, body)
+	stored = err == nil
+	if err != nil {
+		writeStatus(s, gemipfs.RepoError, []byte(err.Error()))
+		return
+	}
+	log.Printf("p2p put %s\n", c.String())
+	writeStatus(s, gemipfs.RepoOK, c.Bytes())
+}
+
+func (repo *Repo) p2pGet(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(p2pTimeout))
+	_, c, err := cid.CidFromReader(s)
+	if err != nil {
+		writeStatus(s, gemipfs.RepoError, []byte("could not parse query"))
+		return
+	}
+	ctx, cncl := context.WithTimeout(context.Background(), p2pTimeout)
+	defer cncl()
+	blk, err := repo.bs.Get(ctx, c)
+	if err != nil {
+		writeStatus(s, gemipfs.RepoNotFound, nil)
+		return
+	}
+	log.Printf("p2p get %s (resp is %d bytes)\n", c.String(), len(blk.RawData()))
+	writeStatus(s, gemipfs.RepoOK, blk.RawData())
+}
+
+func writeStatus(s network.Stream, status gemipfs.RepoStatus, body []byte) {
+	if _, err := s.Write(append([]byte{byte(status)}, body...)); err != nil {
+		log.Printf("failed to respond on stream: %v\n", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multihash"
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+// newTestRepo serves a repo over an in-memory network, returning a client
+// host connected to it.
+func newTestRepo(t *testing.T) (host.Host, peer.AddrInfo) {
+	t.Helper()
+	bs := newTestBlockstore(t)
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mn.Close() })
+	hosts := mn.Hosts()
+	repo := &Repo{bs: bs}
+	repo.serveLibP2P(hosts[0])
+	return hosts[1], peer.AddrInfo{ID: hosts[0].ID()}
+}
+
+func TestP2PPutGet(t *testing.T) {
+	h, ai := newTestRepo(t)
+	ctx := context.Background()
+
+	blk := []byte("a sealed response")
+	c, err := gemipfs.PutToRepo(ctx, h, ai, blk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gemipfs.GetFromRepo(ctx, h, ai, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, blk) {
+		t.Fatalf("got %q, want %q", got, blk)
+	}
+
+	want, err := cid.V1Builder{Codec: c.Prefix().Codec, MhType: c.Prefix().MhType, MhLength: -1}.Sum(blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(want) {
+		t.Fatalf("stored as %s, want %s", c, want)
+	}
+}
+
+func TestP2PGetMissing(t *testing.T) {
+	h, ai := newTestRepo(t)
+	c, err := cid.V1Builder{Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte("never stored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gemipfs.GetFromRepo(context.Background(), h, ai, c); !errors.Is(err, gemipfs.ErrNotInRepo) {
+		t.Fatalf("got %v, want %v", err, gemipfs.ErrNotInRepo)
+	}
+}
+
+func TestP2PPutTooLarge(t *testing.T) {
+	h, ai := newTestRepo(t)
+	blk := make([]byte, gemipfs.MaxBlockSize+1)
+	if _, err := gemipfs.PutToRepo(context.Background(), h, ai, blk, nil); err == nil {
+		t.Fatal("stored a block over the size limit")
+	}
+}
+
+func TestP2PGetForged(t *testing.T) {
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mn.Close() })
+	hosts := mn.Hosts()
+	// a repo answering every get with the same block.
+	hosts[0].SetStreamHandler(gemipfs.RepoGetProtocol, func(s network.Stream) {
+		defer s.Close()
+		s.Write(append([]byte{byte(gemipfs.RepoOK)}, "forged"...))
+	})
+
+	c, err := cid.V1Builder{Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte("asked for"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := gemipfs.GetFromRepo(context.Background(), hosts[1], peer.AddrInfo{ID: hosts[0].ID()}, c); err == nil {
+		t.Fatalf("accepted %q as %s", b, c)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+// getOrSetIssuer loads the privacy pass issuer key, generating one on first
+// run.
+func getOrSetIssuer(loc string) (*gemipfs.TokenIssuer, error) {
+	var sk *rsa.PrivateKey
+	if _, err := os.Stat(loc); os.IsNotExist(err) {
+		sk, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		pk := pem.EncodeToMemory(&pem.Block{
+			Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(sk),
+		})
+		if err := os.WriteFile(loc, pk, 0600); err != nil {
+			return nil, err
+		}
+	} else {
+		pk, err := os.ReadFile(loc)
+		if err != nil {
+			return nil, err
+		}
+		blk, _ := pem.Decode(pk)
+		if blk == nil {
+			return nil, errors.New("token key is not pem encoded")
+		}
+		if sk, err = x509.ParsePKCS1PrivateKey(blk.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	return gemipfs.NewTokenIssuer(sk)
+}
@@ -0,0 +1,82 @@
+// ucan-delegate issues UCAN delegations letting exits relay for a service.
+//
+//	ucan-delegate -key <key file>                          print the key's DID
+//	ucan-delegate -key <key file> -aud <did> [-proof <chain file>]
+//
+// Without a proof the key is the service, and the delegation is the root of
+// the chain. With one, the chain is extended to the audience. The resulting
+// chain is written to stdout, leaf first. The key file is a libp2p identity,
+// as managed by gemipfs-key, and is created if missing.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	gemipfs "github.com/willscott/go-gemipfs/lib"
+)
+
+func main() {
+	keyFile := flag.String("key", "ucan.key", "libp2p private key to delegate with")
+	aud := flag.String("aud", "", "DID to delegate to")
+	proof := flag.String("proof", "", "chain file granting the key the exit ability")
+	exp := flag.Duration("exp", 30*24*time.Hour, "how long the delegation is valid for")
+	flag.Parse()
+
+	if err := run(*keyFile, *aud, *proof, *exp); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(keyFile, aud, proof string, exp time.Duration) error {
+	sk, err := gemipfs.LoadOrCreateIdentity(keyFile)
+	if err != nil {
+		return err
+	}
+	did, err := gemipfs.DIDFromPubKey(sk.GetPublic())
+	if err != nil {
+		return err
+	}
+	if aud == "" {
+		fmt.Println(did)
+		return nil
+	}
+
+	service := did
+	expiry := time.Now().Add(exp)
+	var chain []*gemipfs.UCAN
+	if proof != "" {
+		b, err := os.ReadFile(proof)
+		if err != nil {
+			return err
+		}
+		if chain, err = gemipfs.ParseUCANChain(b); err != nil {
+			return err
+		}
+		if len(chain) == 0 {
+			return errors.New("empty proof chain")
+		}
+		if chain[0].Audience != did {
+			return fmt.Errorf("proof is for %s, not %s", chain[0].Audience, did)
+		}
+		service = chain[len(chain)-1].Issuer
+		// a delegation can't outlive its proof.
+		if !chain[0].Expiry.IsZero() && chain[0].Expiry.Before(expiry) {
+			expiry = chain[0].Expiry
+		}
+	}
+	var proofs []*gemipfs.UCAN
+	if len(chain) > 0 {
+		proofs = chain[:1]
+	}
+	leaf, err := gemipfs.IssueUCAN(sk, aud, []gemipfs.Capability{{With: service, Can: gemipfs.ExitAbility}}, expiry, proofs...)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(gemipfs.MarshalUCANChain(append([]*gemipfs.UCAN{leaf}, chain...)))
+	return err
+}